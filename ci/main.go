@@ -75,7 +75,7 @@ func (m *Ci) BaseContainer(ctx context.Context, src *dagger.Directory) *dagger.C
 		From("alpine:3.19").
 		WithExposedPort(8080).
 		WithFile("/pocketci", pocketci).
-		WithExec([]string{"apk", "add", "--update", "--no-cache", "docker", "openrc"}).
+		WithExec([]string{"apk", "add", "--update", "--no-cache", "docker", "openrc", "git", "git-lfs"}).
 		WithFile(
 			"dagger.tgz",
 			dag.HTTP("https://github.com/dagger/dagger/releases/download/v0.12.5/dagger_v0.12.5_linux_amd64.tar.gz"),
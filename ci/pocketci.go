@@ -23,6 +23,7 @@ func (m *Ci) Pipelines(ctx context.Context) *dagger.File {
 		OnPush([]string{"main"}).
 		Module("ci").
 		Call("publish --sha env:COMMIT_SHA --username env:GH_USERNAME --password env:GH_PASSWORD").
+		Secrets([]string{"ghUsername", "ghPassword"}).
 		After([]*dagger.GhaPipeline{checks})
 
 	return dag.Gha().Pipelines([]*dagger.GhaPipeline{checks, publish})
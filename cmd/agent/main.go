@@ -12,6 +12,8 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"dagger.io/dagger"
@@ -20,11 +22,26 @@ import (
 
 var (
 	controlPlane = flag.String("control-plane", "", "url to control plane host")
+	configPath   = flag.String("config", "", "path to the pocketci configuration file")
 	interval     = flag.Duration("interval", 5*time.Second, "interval between pipeline polls")
 	runnerName   = flag.String("runner-name", "", "name of the runner that identifies it")
 	parallelism  = flag.Int("parallelism", 10, "max number of dagger calls to run in parallel")
+	mirrorDepth  = flag.Int("mirror-depth", pocketci.DefaultMirrorDepth, "history depth of new repository mirrors, 0 fetches the whole history")
+	mirrorDir    = flag.String("mirror-dir", pocketci.DefaultMirrorsPath(), "directory where repository mirrors are stored")
+	blobless     = flag.Bool("blobless", true, "only fetch the contents of the files that are checked out")
+	snapshotDir  = flag.String("snapshot-dir", pocketci.DefaultSnapshotsPath(), "directory where snapshots downloaded from the control plane are cached")
 
 	ErrNoPipeline = errors.New("no pipeline to run")
+
+	// client authenticates the requests made to the control plane.
+	client = &http.Client{}
+
+	// snapshotsInUse counts the running pipelines of each snapshot, so their
+	// snapshots are not pruned from under them.
+	snapshotsInUse = struct {
+		sync.Mutex
+		count map[string]int
+	}{count: map[string]int{}}
 )
 
 func main() {
@@ -39,7 +56,7 @@ func main() {
 
 	ctx := context.Background()
 
-	client, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
+	dag, err := dagger.Connect(ctx, dagger.WithLogOutput(os.Stderr))
 	if err != nil {
 		log.Fatalf("failed to connect to dagger client: %s", err)
 	}
@@ -49,9 +66,37 @@ func main() {
 		mu <- true
 	}
 
-	githubUser := os.Getenv("GITHUB_USERNAME")
-	githubPass := os.Getenv("GITHUB_TOKEN")
-	netrc := client.SetSecret("github_auth", fmt.Sprintf("machine github.com login %s password %s", githubUser, githubPass))
+	config := &pocketci.Config{}
+	if *configPath != "" {
+		if config, err = pocketci.LoadConfig(*configPath); err != nil {
+			log.Fatalf("failed to load config: %s", err)
+		}
+	}
+
+	agentToken, err := config.AgentToken()
+	if err != nil {
+		log.Fatalf("failed to configure agent: %s", err)
+	}
+	client.Transport = &pocketci.AgentTransport{Token: agentToken}
+
+	credentials, err := config.CredentialProvider()
+	if err != nil {
+		log.Fatalf("failed to configure credentials: %s", err)
+	}
+
+	mirrors, err := pocketci.NewMirrors(*mirrorDir, credentials)
+	if err != nil {
+		log.Fatalf("failed to create mirrors: %s", err)
+	}
+	mirrors.Depth = *mirrorDepth
+	mirrors.Blobless = *blobless
+
+	snapshots, err := pocketci.NewSnapshots(*snapshotDir)
+	if err != nil {
+		log.Fatalf("failed to create snapshots: %s", err)
+	}
+	snapshots.Client = client
+	go snapshots.PruneUnused(ctx, usedSnapshots)
 
 	for {
 		pipeline, err := getPipeline(ctx)
@@ -72,26 +117,59 @@ func main() {
 				mu <- true
 			}()
 
-			run(ctx, client, netrc, pipeline)
-			pipelineDone(pipeline)
+			status, logs := run(ctx, dag, mirrors, snapshots, pipeline)
+			pipelineDone(pipeline, status, pocketci.RedactSecrets(logs, pipeline.Secrets))
 		}()
 
 		time.Sleep(*interval)
 	}
 }
 
-func pipelineDone(pipeline *pocketci.PocketciPipeline) {
-	res, err := http.Post(*controlPlane+"/pipelines/"+strconv.Itoa(pipeline.ID), "application/json", nil)
+func pipelineDone(pipeline *pocketci.PocketciPipeline, status pocketci.PipelineStatus, logs string) {
+	buf := bytes.NewBuffer([]byte{})
+	req := pocketci.PipelineDoneRequest{ID: pipeline.ID, Attempt: pipeline.Attempt, Status: status, Logs: logs}
+	if err := json.NewEncoder(buf).Encode(req); err != nil {
+		slog.Error("could not mark pipeline as done", slog.String("error", err.Error()))
+		return
+	}
+
+	res, err := client.Post(*controlPlane+"/pipelines/"+strconv.Itoa(pipeline.ID), "application/json", buf)
 	if err != nil {
 		slog.Error("could not mark pipeline as done", slog.String("error", err.Error()))
 		return
 	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusNoContent {
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		slog.Info("pipeline is done", slog.Int("pipeline", pipeline.ID), slog.String("status", string(status)))
+	case http.StatusConflict:
+		slog.Warn("the attempt of the pipeline is no longer running, its report was ignored",
+			slog.Int("pipeline", pipeline.ID), slog.Int("attempt", pipeline.Attempt))
+	default:
 		slog.Error("could not mark pipeline as done", slog.Int("status_code", res.StatusCode))
 	}
-	slog.Info("pipeline is done", slog.Int("pipeline", pipeline.ID))
+}
+
+// pipelineStarted tells the control plane that the call of the pipeline
+// starts, so its timeout doesn't count the checkout.
+func pipelineStarted(pipeline *pocketci.PocketciPipeline) {
+	buf := bytes.NewBuffer([]byte{})
+	if err := json.NewEncoder(buf).Encode(pocketci.PipelineStartedRequest{Attempt: pipeline.Attempt}); err != nil {
+		slog.Error("could not mark pipeline as started", slog.String("error", err.Error()))
+		return
+	}
+
+	res, err := client.Post(*controlPlane+"/pipelines/"+strconv.Itoa(pipeline.ID)+"/started", "application/json", buf)
+	if err != nil {
+		slog.Error("could not mark pipeline as started", slog.String("error", err.Error()))
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		slog.Error("could not mark pipeline as started", slog.Int("status_code", res.StatusCode))
+	}
 }
 
 func getPipeline(ctx context.Context) (*pocketci.PocketciPipeline, error) {
@@ -100,10 +178,14 @@ func getPipeline(ctx context.Context) (*pocketci.PocketciPipeline, error) {
 		return nil, err
 	}
 
-	res, err := http.Post(*controlPlane+"/pipelines/claim", "application/json", buf)
+	res, err := client.Post(*controlPlane+"/pipelines/claim", "application/json", buf)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, errors.New("the control plane rejected the agent token")
+	}
 	if res.StatusCode == http.StatusNoContent {
 		return nil, ErrNoPipeline
 	}
@@ -116,33 +198,50 @@ func getPipeline(ctx context.Context) (*pocketci.PocketciPipeline, error) {
 	return pipeline, nil
 }
 
-func run(ctx context.Context, dag *dagger.Client, netrc *dagger.Secret, req *pocketci.PocketciPipeline) {
-	repoUrl := "https://github.com/" + req.Repository
-	slog.Info("cloning repository", slog.String("repository", repoUrl),
-		slog.String("ref", req.GitInfo.Branch), slog.String("sha", req.GitInfo.SHA))
+// run runs the call of the pipeline and returns how it ended together with
+// its logs. Failures that happen outside of the call are infra errors.
+func run(ctx context.Context, dag *dagger.Client, mirrors *pocketci.Mirrors, snapshots *pocketci.Snapshots, req *pocketci.PocketciPipeline) (pocketci.PipelineStatus, string) {
+	repoUrl := pocketci.GithubURL(req.Repository)
 
-	repo, err := pocketci.BaseContainer(dag).
-		WithEnvVariable("CACHE_BUST", time.Now().String()).
-		WithMountedSecret("/root/.netrc", netrc).
-		WithExec([]string{"git", "clone", "--single-branch", "--branch", req.GitInfo.Branch, "--depth", "1", repoUrl, "/app"}).
-		WithWorkdir("/app").
-		WithExec([]string{"git", "checkout", req.GitInfo.SHA}).
-		Directory("/app").
-		Sync(ctx)
-	if err != nil {
-		slog.Error("failed to clonse github repository", slog.String("error", err.Error()),
-			slog.String("repository", repoUrl), slog.String("ref", req.GitInfo.Branch), slog.String("sha", req.GitInfo.SHA))
-		return
+	ref, sha := req.GitInfo.Ref, req.GitInfo.SHA
+	if req.MergeRef {
+		ref, sha = req.GitInfo.MergeRef, req.GitInfo.MergeSHA
+	}
+
+	var repo *dagger.Directory
+	var err error
+	if req.Snapshot != "" {
+		defer useSnapshot(req.Snapshot)()
+
+		slog.Info("downloading snapshot", slog.String("repository", repoUrl), slog.String("snapshot", req.Snapshot))
+		repo, err = snapshot(ctx, dag, snapshots, req.Snapshot)
+		if err != nil {
+			slog.Error("failed to download snapshot", slog.String("error", err.Error()),
+				slog.String("repository", repoUrl), slog.String("snapshot", req.Snapshot))
+			return pocketci.PipelineInfraError, err.Error()
+		}
+	} else {
+		slog.Info("cloning repository", slog.String("repository", repoUrl),
+			slog.String("ref", ref), slog.String("sha", sha))
+
+		opts := req.GitInfo.Checkout
+		opts.Paths = req.Paths
+		repo, err = checkout(ctx, dag, mirrors, repoUrl, ref, sha, opts)
+		if err != nil {
+			slog.Error("failed to clonse github repository", slog.String("error", err.Error()),
+				slog.String("repository", repoUrl), slog.String("ref", ref), slog.String("sha", sha))
+			return pocketci.PipelineInfraError, err.Error()
+		}
 	}
 
 	vars := map[string]string{
-		"GITHUB_SHA":     req.GitInfo.SHA,
+		"GITHUB_SHA":     sha,
 		"GITHUB_ACTIONS": "true",
 	}
 
 	slog.Info("launching pocketci agent container",
 		slog.String("repository_name", req.Repository), slog.String("pipeline", req.Name),
-		slog.String("ref", req.GitInfo.Branch), slog.String("sha", req.GitInfo.SHA),
+		slog.String("ref", ref), slog.String("sha", sha),
 		slog.String("module", req.Module), slog.String("exec", req.Call),
 		slog.String("runs_on", req.Runner))
 
@@ -150,12 +249,32 @@ func run(ctx context.Context, dag *dagger.Client, netrc *dagger.Secret, req *poc
 	if req.Module != "" && req.Module != "." {
 		call = fmt.Sprintf("dagger call -m %s --progress plain %s", req.Module, req.Call)
 	}
+
+	// cancelling the context of the exec makes the engine stop the call
+	execCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if req.Timeout > 0 {
+		execCtx, cancel = context.WithTimeout(execCtx, req.Timeout)
+		defer cancel()
+	}
+
+	pipelineStarted(req)
+
+	cancelled := &atomic.Bool{}
+	go watchCancellation(execCtx, req, func() {
+		cancelled.Store(true)
+		cancel()
+	})
 	stdout, err := pocketci.AgentContainer(dag).
 		WithEnvVariable("CACHE_BUST", time.Now().String()).
 		WithEnvVariable("DAGGER_CLOUD_TOKEN", os.Getenv("DAGGER_CLOUD_TOKEN")).
 		WithDirectory("/app", repo).
 		WithWorkdir("/app").
 		WithEnvVariable("CI", "pocketci").
+		WithNewFile(pocketci.EventTriggerPath, string(req.EventTrigger)).
+		With(pocketci.WithVariables(req.Variables)).
+		With(pocketci.WithSecrets(dag, req.Repository, req.Secrets)).
+		WithEnvVariable("POCKETCI_EVENT_TRIGGER", pocketci.EventTriggerPath).
 		With(func(c *dagger.Container) *dagger.Container {
 			for key, val := range vars {
 				c = c.WithEnvVariable(key, val)
@@ -165,9 +284,101 @@ func run(ctx context.Context, dag *dagger.Client, netrc *dagger.Secret, req *poc
 				ExperimentalPrivilegedNesting: true,
 			})
 		}).
-		Stdout(ctx)
+		Stdout(execCtx)
+	if cancelled.Load() {
+		slog.Info("pipeline was cancelled", slog.Int("pipeline", req.ID))
+		return pocketci.PipelineCancelled, "call cancelled by a newer run of its concurrency group or because the attempt is no longer running"
+	}
+	if errors.Is(execCtx.Err(), context.DeadlineExceeded) {
+		slog.Error("pipeline timed out", slog.Int("pipeline", req.ID), slog.Duration("timeout", req.Timeout))
+		return pocketci.PipelineTimedOut, fmt.Sprintf("call timed out after %s", req.Timeout)
+	}
+	var execErr *dagger.ExecError
+	if errors.As(err, &execErr) {
+		return pocketci.PipelineFailed, execErr.Stdout + execErr.Stderr
+	}
 	if err != nil {
-		return
+		return pocketci.PipelineInfraError, err.Error()
+	}
+	fmt.Println(pocketci.RedactSecrets(stdout, req.Secrets))
+	return pocketci.PipelineSucceeded, stdout
+}
+
+// watchCancellation polls the control plane until `ctx` is done and calls
+// `cancel` if the attempt of the pipeline has to stop meanwhile.
+func watchCancellation(ctx context.Context, pipeline *pocketci.PocketciPipeline, cancel func()) {
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		res, err := client.Get(fmt.Sprintf("%s/pipelines/%d/cancelled?attempt=%d", *controlPlane, pipeline.ID, pipeline.Attempt))
+		if err != nil {
+			slog.Error("could not check if pipeline was cancelled", slog.String("error", err.Error()))
+			continue
+		}
+
+		status := &pocketci.PipelineCancelledResponse{}
+		err = json.NewDecoder(res.Body).Decode(status)
+		res.Body.Close()
+		if err != nil {
+			slog.Error("could not check if pipeline was cancelled", slog.String("error", err.Error()))
+			continue
+		}
+		if status.Cancelled {
+			cancel()
+			return
+		}
+	}
+}
+
+// useSnapshot keeps the snapshot identified by `digest` from being pruned
+// until the returned function is called.
+func useSnapshot(digest string) func() {
+	snapshotsInUse.Lock()
+	defer snapshotsInUse.Unlock()
+	snapshotsInUse.count[digest]++
+
+	return func() {
+		snapshotsInUse.Lock()
+		defer snapshotsInUse.Unlock()
+		if snapshotsInUse.count[digest]--; snapshotsInUse.count[digest] == 0 {
+			delete(snapshotsInUse.count, digest)
+		}
+	}
+}
+
+// usedSnapshots returns the snapshots of the running pipelines.
+func usedSnapshots() map[string]bool {
+	snapshotsInUse.Lock()
+	defer snapshotsInUse.Unlock()
+
+	used := map[string]bool{}
+	for digest := range snapshotsInUse.count {
+		used[digest] = true
+	}
+	return used
+}
+
+func snapshot(ctx context.Context, dag *dagger.Client, snapshots *pocketci.Snapshots, digest string) (*dagger.Directory, error) {
+	dir, err := snapshots.Fetch(ctx, *controlPlane, digest)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println(stdout)
+
+	return dag.Host().Directory(dir).Sync(ctx)
+}
+
+func checkout(ctx context.Context, dag *dagger.Client, mirrors *pocketci.Mirrors, repoUrl, ref, sha string, opts pocketci.CheckoutOptions) (*dagger.Directory, error) {
+	mirror, err := mirrors.Fetch(ctx, repoUrl, sha, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	return mirror.Snapshot(ctx, dag, sha, opts)
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"dagger.io/dagger"
+	"github.com/franela/pocketci/pocketci"
+)
+
+const usage = `usage: pocketci <command> [flags]
+
+commands:
+  validate  discover the pipelines of the working tree and validate them
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "validate":
+		os.Exit(validate(os.Args[2:]))
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// validate runs the `validate` command. It is meant to be used as a
+// pre-commit hook, so it exits with a non-zero code when the spec or the
+// pipelines are invalid.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	dir := flags.String("dir", ".", "root of the git working tree to validate")
+	repository := flags.String("repository", "", "full name of the repository passed to discovery, defaults to the name of the directory")
+	branch := flags.String("branch", "main", "branch the working tree is discovered as pushed to")
+	verbose := flags.Bool("verbose", false, "whether to enable verbose output")
+	configPath := flags.String("config", "", "path to the pocketci configuration file with the credentials of included specs")
+	mirrorDir := flags.String("mirror-dir", pocketci.DefaultMirrorsPath(), "directory where the mirrors of included specs are stored")
+	flags.Parse(args)
+
+	config := &pocketci.Config{}
+	if *configPath != "" {
+		var err error
+		if config, err = pocketci.LoadConfig(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to load config: %s\n", err)
+			return 1
+		}
+	}
+
+	credentials, err := config.CredentialProvider()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to configure credentials: %s\n", err)
+		return 1
+	}
+
+	mirrors, err := pocketci.NewMirrors(*mirrorDir, credentials)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create mirrors: %s\n", err)
+		return 1
+	}
+
+	if *repository == "" {
+		abs, err := filepath.Abs(*dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid directory: %s\n", err)
+			return 1
+		}
+		*repository = "local/" + filepath.Base(abs)
+	}
+
+	ctx := context.Background()
+	out := io.Discard
+	if *verbose {
+		out = os.Stderr
+	}
+	client, err := dagger.Connect(ctx, dagger.WithLogOutput(out))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect to dagger: %s\n", err)
+		return 1
+	}
+	defer client.Close()
+
+	pipelines, err := pocketci.Validate(ctx, client, pocketci.NewSpecIncludes(mirrors), *dir, *repository, *branch)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	for _, p := range pipelines {
+		fmt.Printf("%s: %d calls\n", p.Name, len(p.Exec))
+	}
+	fmt.Printf("%d pipelines are valid\n", len(pipelines))
+	return 0
+}
@@ -12,7 +12,15 @@ import (
 	"github.com/franela/pocketci/pocketci"
 )
 
-var verbose = flag.Bool("verbose", false, "whether to enable verbose output")
+var (
+	verbose     = flag.Bool("verbose", false, "whether to enable verbose output")
+	configPath  = flag.String("config", "", "path to the pocketci configuration file")
+	mirrorDir   = flag.String("mirror-dir", pocketci.DefaultMirrorsPath(), "directory where repository mirrors are stored")
+	mirrorDepth = flag.Int("mirror-depth", pocketci.DefaultMirrorDepth, "history depth of new repository mirrors, 0 fetches the whole history")
+	blobless    = flag.Bool("blobless", true, "only fetch the contents of the files that are checked out")
+	snapshotDir = flag.String("snapshot-dir", pocketci.DefaultSnapshotsPath(), "directory where the snapshots served to agents are stored, empty disables snapshots")
+	skipToken   = flag.String("skip-token", pocketci.DefaultSkipToken, "directive that, on top of [skip ci] and [ci skip], skips the pipelines of an event")
+)
 
 func main() {
 	flag.Parse()
@@ -28,19 +36,59 @@ func main() {
 	}
 	defer client.Close()
 
+	config := &pocketci.Config{}
+	if *configPath != "" {
+		if config, err = pocketci.LoadConfig(*configPath); err != nil {
+			slog.Error("failed to load config", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
+	credentials, err := config.CredentialProvider()
+	if err != nil {
+		slog.Error("failed to configure credentials", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	agentToken, err := config.AgentToken()
+	if err != nil {
+		slog.Error("failed to configure agents", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
+	secrets, err := config.SecretBackends()
+	if err != nil {
+		slog.Error("failed to configure secrets", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+
 	server, err := pocketci.NewServer(client, pocketci.ServerOptions{
-		GithubUsername:  os.Getenv("GITHUB_USERNAME"),
-		GithubPassword:  os.Getenv("GITHUB_TOKEN"),
 		GithubSignature: os.Getenv("X_HUB_SIGNATURE"),
+		AgentToken:      agentToken,
+		Credentials:     credentials,
+		SkipToken:       *skipToken,
+		MirrorsPath:     *mirrorDir,
+		MirrorDepth:     *mirrorDepth,
+		MirrorBlobless:  *blobless,
+		SnapshotsPath:   *snapshotDir,
+		Secrets:         secrets,
+		Variables:       &config.Variables,
 	})
 	if err != nil {
 		slog.Error("failed to create pocketci server", slog.String("error", err.Error()))
+		os.Exit(1)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", server)
-	mux.HandleFunc("POST /pipelines/{pipeline_id}", server.PipelineDoneHandler)
-	mux.HandleFunc("POST /pipelines/claim", server.PipelineClaimHandler)
+	mux.HandleFunc("POST /pipelines/{pipeline_id}", server.AgentHandler(server.PipelineDoneHandler))
+	mux.HandleFunc("POST /pipelines/claim", server.AgentHandler(server.PipelineClaimHandler))
+	mux.HandleFunc("POST /pipelines/{pipeline_id}/started", server.AgentHandler(server.PipelineStartedHandler))
+	mux.HandleFunc("GET /pipelines/{pipeline_id}/attempts", server.PipelineAttemptsHandler)
+	mux.HandleFunc("GET /pipelines/{pipeline_id}/cancelled", server.AgentHandler(server.PipelineCancelledHandler))
+	mux.HandleFunc("GET /runs", server.RunsHandler)
+	mux.HandleFunc("GET /runs/{run_id}", server.RunHandler)
+	mux.HandleFunc("GET /snapshots/{digest}", server.AgentHandler(server.SnapshotHandler))
 	srv := &http.Server{
 		Addr:    ":8080",
 		Handler: mux,
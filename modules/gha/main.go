@@ -3,6 +3,8 @@ package main
 import (
 	"dagger/gha/internal/dagger"
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/franela/pocketci/pocketci"
 )
@@ -15,6 +17,8 @@ type Pipeline struct {
 	// +private
 	Changes []string
 	// +private
+	ChangeStatuses []string
+	// +private
 	UseModule string
 	// +private
 	Name string
@@ -23,6 +27,10 @@ type Pipeline struct {
 	// +private
 	MatchOnPR bool
 	// +private
+	SkipDraft bool
+	// +private
+	UseMergeRef bool
+	// +private
 	BaseBranches []string
 	// +private
 	MatchOnPush bool
@@ -32,6 +40,51 @@ type Pipeline struct {
 	Exec string
 	// +private
 	PipelineDeps []string
+	// +private
+	CheckoutPaths []string
+	// +private
+	SecretNames []string
+	// +private
+	MatrixAxes []*MatrixAxis
+	// +private
+	MatrixIncludes []string
+	// +private
+	MatrixExcludes []string
+	// +private
+	CallTimeout string
+	// +private
+	RetryPolicy *RetryPolicy
+	// +private
+	Condition string
+	// +private
+	EnvVariables []*EnvVariable
+	// +private
+	ConcurrencyGroup string
+	// +private
+	CancelInProgress bool
+}
+
+type EnvVariable struct {
+	// +private
+	Name string
+	// +private
+	Value string
+}
+
+type RetryPolicy struct {
+	// +private
+	Retries int
+	// +private
+	Backoff string
+	// +private
+	InfraOnly bool
+}
+
+type MatrixAxis struct {
+	// +private
+	Name string
+	// +private
+	Values []string
 }
 
 type Action string
@@ -40,6 +93,18 @@ const (
 	PROpened      Action = "opened"
 	PRReopened    Action = "reopened"
 	PRSynchronize Action = "synchronize"
+	// PRReadyForReview is sent when a draft pull request is marked as ready
+	// for review.
+	PRReadyForReview Action = "ready_for_review"
+)
+
+type ChangeStatus string
+
+const (
+	Added    ChangeStatus = "added"
+	Modified ChangeStatus = "modified"
+	Deleted  ChangeStatus = "deleted"
+	Renamed  ChangeStatus = "renamed"
 )
 
 // Returns a container that echoes whatever string argument is provided
@@ -62,6 +127,8 @@ func (m *Pipeline) OnPullRequest(actions ...Action) *Pipeline {
 	return m
 }
 
+// OnPullRequestAgainst triggers the pipeline on pull requests whose base
+// branch matches one of `branches`, which can be globs such as `release/*`.
 func (m *Pipeline) OnPullRequestAgainst(actions []Action, branches []string) *Pipeline {
 	a := []string{}
 	for _, action := range actions {
@@ -69,6 +136,21 @@ func (m *Pipeline) OnPullRequestAgainst(actions []Action, branches []string) *Pi
 	}
 	m.MatchActions = a
 	m.MatchOnPR = true
+	m.BaseBranches = branches
+	return m
+}
+
+// SkipDrafts defers the pull request triggers of the pipeline while the pull
+// request is a draft. Once it is marked as ready for review the pipeline runs.
+func (m *Pipeline) SkipDrafts() *Pipeline {
+	m.SkipDraft = true
+	return m
+}
+
+// CheckoutMergeRef makes the pipeline test the result of merging the pull
+// request into its base branch (`refs/pull/<number>/merge`) instead of its head.
+func (m *Pipeline) CheckoutMergeRef() *Pipeline {
+	m.UseMergeRef = true
 	return m
 }
 
@@ -77,6 +159,108 @@ func (m *Pipeline) OnChanges(paths ...string) *Pipeline {
 	return m
 }
 
+// OnChangeStatus only considers the files that changed with one of the given
+// statuses, e.g. to run a pipeline when files are added under `OnChanges`
+// paths but not when they are modified.
+func (m *Pipeline) OnChangeStatus(statuses ...ChangeStatus) *Pipeline {
+	s := []string{}
+	for _, status := range statuses {
+		s = append(s, string(status))
+	}
+	m.ChangeStatuses = s
+	return m
+}
+
+// Paths limits the checkout of the pipeline to its module plus the given
+// paths, which can be globs. Large repositories are much faster to check out
+// this way.
+func (m *Pipeline) Paths(paths ...string) *Pipeline {
+	m.CheckoutPaths = paths
+	return m
+}
+
+// Secrets declares the secrets of `pocketci.yaml` the pipeline uses. Only
+// these are handed to the agent that runs it, and calls that reference any
+// other secret are rejected.
+func (m *Pipeline) Secrets(names ...string) *Pipeline {
+	m.SecretNames = names
+	return m
+}
+
+// Matrix adds an axis to the matrix of the pipeline, which then runs once for
+// each combination of the values of its axes. The call can reference the value
+// of each axis, e.g. `test --go-version {{.go}}`.
+func (m *Pipeline) Matrix(axis string, values ...string) *Pipeline {
+	m.MatrixAxes = append(m.MatrixAxes, &MatrixAxis{Name: axis, Values: values})
+	return m
+}
+
+// MatrixInclude adds a combination to the matrix of the pipeline, given as
+// `key=value` entries. Its keys don't need to be axes of the matrix.
+func (m *Pipeline) MatrixInclude(combination ...string) *Pipeline {
+	m.MatrixIncludes = append(m.MatrixIncludes, strings.Join(combination, ","))
+	return m
+}
+
+// MatrixExclude removes the combinations of the matrix of the pipeline that
+// have every one of the given `key=value` entries.
+func (m *Pipeline) MatrixExclude(combination ...string) *Pipeline {
+	m.MatrixExcludes = append(m.MatrixExcludes, strings.Join(combination, ","))
+	return m
+}
+
+// Timeout limits how long the call of the pipeline can run, e.g. `30m`. The
+// agent cancels calls that run longer and the pipeline is marked as timed out.
+func (m *Pipeline) Timeout(timeout string) *Pipeline {
+	m.CallTimeout = timeout
+	return m
+}
+
+// Retries runs the pipeline again up to `retries` times, at most 10, when it
+// fails. Only its last attempt unblocks the pipelines that run after it.
+func (m *Pipeline) Retries(
+	retries int,
+	// delay before the first retry, e.g. `30s`. It doubles on every retry up
+	// to an hour.
+	// +optional
+	backoff string,
+	// only retry infrastructure errors, not failed or timed out calls
+	// +optional
+	infraOnly bool,
+) *Pipeline {
+	m.RetryPolicy = &RetryPolicy{Retries: retries, Backoff: backoff, InfraOnly: infraOnly}
+	return m
+}
+
+// If only triggers the pipeline when `expr` holds for the event, e.g.
+// `labels contains "deploy" && branch == "main"`. A pipeline without other
+// triggers runs on every event `expr` holds for.
+func (m *Pipeline) If(expr string) *Pipeline {
+	m.Condition = expr
+	return m
+}
+
+// Env sets an environment variable of the call. Like the call, the value is
+// rendered with the event, e.g. `{{.Branch}}-{{.SHA}}`.
+func (m *Pipeline) Env(key, value string) *Pipeline {
+	m.EnvVariables = append(m.EnvVariables, &EnvVariable{Name: key, Value: value})
+	return m
+}
+
+// Concurrency runs the pipelines of `group` one at a time. Like the call, the
+// group is rendered with the event, e.g. `preview-{{.PR.Number}}`. With
+// `cancelInProgress` a new run cancels the pipelines of the group that older
+// runs queued or are running.
+func (m *Pipeline) Concurrency(
+	group string,
+	// +optional
+	cancelInProgress bool,
+) *Pipeline {
+	m.ConcurrencyGroup = group
+	m.CancelInProgress = cancelInProgress
+	return m
+}
+
 func (m *Pipeline) OnPush(branches ...string) *Pipeline {
 	m.MatchOnPush = true
 	m.MatchBranches = branches
@@ -102,21 +286,102 @@ func (m *Pipeline) After(pipelines ...*Pipeline) *Pipeline {
 	return m
 }
 
+func changeStatuses(statuses []string) []pocketci.ChangeStatus {
+	s := []pocketci.ChangeStatus{}
+	for _, status := range statuses {
+		s = append(s, pocketci.ChangeStatus(status))
+	}
+	return s
+}
+
+func matrixCombination(combination string) (map[string]string, error) {
+	c := map[string]string{}
+	for _, entry := range strings.Split(combination, ",") {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid matrix entry %q, expected key=value", entry)
+		}
+		c[key] = value
+	}
+	return c, nil
+}
+
+func (p *Pipeline) matrix() (*pocketci.Matrix, error) {
+	if len(p.MatrixAxes) == 0 && len(p.MatrixIncludes) == 0 {
+		return nil, nil
+	}
+
+	matrix := &pocketci.Matrix{}
+	for _, axis := range p.MatrixAxes {
+		matrix.Axes = append(matrix.Axes, pocketci.MatrixAxis{Name: axis.Name, Values: axis.Values})
+	}
+	for _, include := range p.MatrixIncludes {
+		c, err := matrixCombination(include)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		matrix.Include = append(matrix.Include, c)
+	}
+	for _, exclude := range p.MatrixExcludes {
+		c, err := matrixCombination(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		matrix.Exclude = append(matrix.Exclude, c)
+	}
+	return matrix, nil
+}
+
 func (m *Gha) Pipelines(pipelines []*Pipeline) (*dagger.File, error) {
 	ps := []pocketci.Pipeline{}
 
 	for _, p := range pipelines {
+		matrix, err := p.matrix()
+		if err != nil {
+			return nil, err
+		}
+
+		var retry *pocketci.RetryPolicy
+		if p.RetryPolicy != nil {
+			retry = &pocketci.RetryPolicy{Retries: p.RetryPolicy.Retries, Backoff: p.RetryPolicy.Backoff, InfraOnly: p.RetryPolicy.InfraOnly}
+		}
+
+		var env map[string]string
+		for _, v := range p.EnvVariables {
+			if env == nil {
+				env = map[string]string{}
+			}
+			env[v.Name] = v.Value
+		}
+
+		var concurrency *pocketci.ConcurrencyPolicy
+		if p.ConcurrencyGroup != "" {
+			concurrency = &pocketci.ConcurrencyPolicy{Group: p.ConcurrencyGroup, CancelInProgress: p.CancelInProgress}
+		}
+
 		ps = append(ps, pocketci.Pipeline{
-			Name:         p.Name,
-			Runner:       p.Runner,
-			Changes:      p.Changes,
-			Module:       p.UseModule,
-			Actions:      p.MatchActions,
-			OnPR:         p.MatchOnPR,
-			OnPush:       p.MatchOnPush,
-			Branches:     p.MatchBranches,
-			Exec:         []string{p.Exec},
-			PipelineDeps: p.PipelineDeps,
+			Name:           p.Name,
+			Runner:         p.Runner,
+			Changes:        p.Changes,
+			Module:         p.UseModule,
+			ChangeStatuses: changeStatuses(p.ChangeStatuses),
+			Actions:        p.MatchActions,
+			OnPR:           p.MatchOnPR,
+			BaseBranches:   p.BaseBranches,
+			SkipDrafts:     p.SkipDraft,
+			MergeRef:       p.UseMergeRef,
+			OnPush:         p.MatchOnPush,
+			Branches:       p.MatchBranches,
+			Exec:           []string{p.Exec},
+			PipelineDeps:   p.PipelineDeps,
+			Paths:          p.CheckoutPaths,
+			Secrets:        p.SecretNames,
+			Matrix:         matrix,
+			Timeout:        p.CallTimeout,
+			Retry:          retry,
+			If:             p.Condition,
+			Env:            env,
+			Concurrency:    concurrency,
 		})
 	}
 
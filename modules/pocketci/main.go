@@ -43,12 +43,17 @@ func New(ctx context.Context, eventTrigger *dagger.File) (*Pocketci, error) {
 		pr := fromGithubPullRequest(event)
 		pr.Event = Event{
 			RepoName:  e.RepoName,
-			Changes:   e.Changes,
+			Changes:   e.changes(),
 			EventType: e.EventType,
 		}
 		return &Pocketci{EventType: EventType(e.EventType), PullRequestEvent: pr}, nil
 	case *github.PushEvent:
 		commitPush := fromGithubPushEvent(event)
+		commitPush.Event = Event{
+			RepoName:  e.RepoName,
+			Changes:   e.changes(),
+			EventType: e.EventType,
+		}
 		return &Pocketci{EventType: EventType(e.EventType), CommitPush: commitPush}, nil
 	default:
 		return nil, fmt.Errorf("event of type %T is not yet supported", event)
@@ -8,10 +8,19 @@ import (
 
 type Event struct {
 	EventType string   `json:"event_type"`
-	Changes   []string `json:"changes"`
+	Changes   []Change `json:"changes"`
 	RepoName  string   `json:"repo_name"`
 }
 
+// Change is a file that changed in the event.
+type Change struct {
+	Path string `json:"path"`
+	// OldPath is the path the file had before being renamed.
+	OldPath string `json:"old_path"`
+	// Status is one of "added", "modified", "deleted" or "renamed".
+	Status string `json:"status"`
+}
+
 // TODO: For some very **VERY** bizarre reason to me, embedding `Event` into this struct
 // breaks the unmarshaling of this object leaving the `payload` field empty. Adding
 // these fields one by one works without any issues
@@ -19,10 +28,25 @@ type Event struct {
 // it as a map or something else it works perfectly. The problem is embedding
 // the event struct. I tried to repro on the go playground and couldn't: https://play.golang.com/p/7jEKgPxhdYE
 type event struct {
-	EventType string          `json:"event_type"`
-	Changes   []string        `json:"changes"`
-	RepoName  string          `json:"repo_name"`
-	Payload   json.RawMessage `json:"payload"`
+	EventType   string          `json:"event_type"`
+	Changes     []string        `json:"changes"`
+	FileChanges []Change        `json:"file_changes"`
+	RepoName    string          `json:"repo_name"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// changes returns the changes of the event. Servers that don't report the
+// status of each change only send their paths.
+func (e *event) changes() []Change {
+	if e.FileChanges != nil {
+		return e.FileChanges
+	}
+
+	changes := []Change{}
+	for _, path := range e.Changes {
+		changes = append(changes, Change{Path: path})
+	}
+	return changes
 }
 
 func fromGithubPullRequest(e *github.PullRequestEvent) *PullRequest {
@@ -58,6 +82,9 @@ func fromGithubPullRequest(e *github.PullRequestEvent) *PullRequest {
 	if e.PullRequest.State != nil {
 		pr.PullRequest.State = *e.PullRequest.State
 	}
+	if e.PullRequest.Draft != nil {
+		pr.PullRequest.Draft = *e.PullRequest.Draft
+	}
 	if e.PullRequest.Locked != nil {
 		pr.PullRequest.Locked = *e.PullRequest.Locked
 	}
@@ -151,6 +178,7 @@ type PullRequest struct {
 type PullRequestSpec struct {
 	Number         int
 	State          string
+	Draft          bool
 	Locked         bool
 	CreatedAt      string
 	UpdatedAt      string
@@ -256,6 +284,8 @@ func fromGithubPushEvent(e *github.PushEvent) *CommitPush {
 }
 
 type CommitPush struct {
+	Event
+
 	Ref     string
 	SHA     string
 	Commits []*HeadCommit
@@ -0,0 +1,58 @@
+package pocketci
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// AgentHandler only lets agents call `h`. Agents receive the secrets of the
+// pipelines they claim, so every route they use requires the agent token
+// shared by the server and its agents.
+func (s *Server) AgentHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.agentToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.agentToken)) != 1 {
+			http.Error(w, "invalid agent token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// AgentTransport sends the agent token along every request of an agent.
+type AgentTransport struct {
+	Token string
+	// Base makes the requests. Defaults to `http.DefaultTransport`.
+	Base http.RoundTripper
+}
+
+func (t *AgentTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	// round trippers must not modify the request they are given
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.Token)
+	return base.RoundTrip(r)
+}
+
+// RedactSecrets replaces the values of `secrets` found in `logs`, so they are
+// neither printed by agents nor recorded along the attempts of pipelines.
+func RedactSecrets(logs string, secrets map[string]string) string {
+	// longer values go first as they might contain shorter ones
+	values := slices.SortedFunc(maps.Values(secrets), func(a, b string) int {
+		return cmp.Compare(len(b), len(a))
+	})
+	for _, value := range values {
+		if value != "" {
+			logs = strings.ReplaceAll(logs, value, "***")
+		}
+	}
+	return logs
+}
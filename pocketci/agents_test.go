@@ -0,0 +1,66 @@
+package pocketci
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestAgentHandler(t *testing.T) {
+	server := &Server{agentToken: "agent-token"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /agents", server.AgentHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cases := []struct {
+		name     string
+		client   *http.Client
+		expected int
+	}{
+		{
+			name:     "agent token",
+			client:   &http.Client{Transport: &AgentTransport{Token: "agent-token"}},
+			expected: http.StatusNoContent,
+		},
+		{
+			name:     "wrong token",
+			client:   &http.Client{Transport: &AgentTransport{Token: "other-token"}},
+			expected: http.StatusUnauthorized,
+		},
+		{
+			name:     "no token",
+			client:   http.DefaultClient,
+			expected: http.StatusUnauthorized,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := tc.client.Get(srv.URL + "/agents")
+			assert.NilError(t, err)
+			res.Body.Close()
+			assert.Equal(t, res.StatusCode, tc.expected)
+		})
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+	err := ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+		{Name: "deploy", Exec: []string{"deploy"}, secrets: map[string]string{"token": "hunter2", "prefixed": "hunter2-admin", "empty": ""}},
+	})
+	assert.NilError(t, err)
+
+	deploy := ld.GetPipeline(ctx, "")
+	assert.NilError(t, ld.PipelineDone(ctx, deploy.ID, deploy.Attempt, PipelineFailed, "login with hunter2-admin failed, retrying with hunter2"))
+
+	attempts, err := ld.Attempts(ctx, deploy.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, attempts[0].Logs, "login with *** failed, retrying with ***")
+}
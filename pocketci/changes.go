@@ -0,0 +1,121 @@
+package pocketci
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ChangeStatus is what happened to a file that changed.
+type ChangeStatus string
+
+const (
+	ChangeAdded    ChangeStatus = "added"
+	ChangeModified ChangeStatus = "modified"
+	ChangeDeleted  ChangeStatus = "deleted"
+	ChangeRenamed  ChangeStatus = "renamed"
+)
+
+// Change is a file that changed in an event.
+type Change struct {
+	Path string `json:"path"`
+	// OldPath is the path the file had before being renamed.
+	OldPath string       `json:"old_path,omitempty"`
+	Status  ChangeStatus `json:"status"`
+}
+
+// parseNameStatus parses the output of `git diff-tree -z --name-status`.
+func parseNameStatus(out string) ([]Change, error) {
+	changes := []Change{}
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i < len(fields) && fields[i] != ""; i++ {
+		status := fields[i]
+		if i+1 >= len(fields) {
+			return nil, fmt.Errorf("unexpected diff output %q", out)
+		}
+
+		switch status[0] {
+		case 'A':
+			changes = append(changes, Change{Path: fields[i+1], Status: ChangeAdded})
+		case 'D':
+			changes = append(changes, Change{Path: fields[i+1], Status: ChangeDeleted})
+		case 'M', 'T':
+			changes = append(changes, Change{Path: fields[i+1], Status: ChangeModified})
+		case 'R':
+			if i+2 >= len(fields) {
+				return nil, fmt.Errorf("unexpected diff output %q", out)
+			}
+			changes = append(changes, Change{Path: fields[i+2], OldPath: fields[i+1], Status: ChangeRenamed})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected diff status %s", status)
+		}
+		i++
+	}
+	return changes, nil
+}
+
+// changedPaths returns every path touched by `changes`, which includes both
+// sides of renames.
+func changedPaths(changes []Change) []string {
+	paths := []string{}
+	for _, c := range changes {
+		if c.OldPath != "" {
+			paths = append(paths, c.OldPath)
+		}
+		paths = append(paths, c.Path)
+	}
+	return paths
+}
+
+// matchChanges reports whether `changes` trigger the pipeline. Only the
+// changes with one of the statuses of the pipeline are considered when it
+// specifies them.
+func matchChanges(changes []Change, p *Pipeline) bool {
+	if len(p.Changes) == 0 && len(p.ChangeStatuses) == 0 {
+		return true
+	}
+
+	patterns := p.Changes
+	if len(patterns) == 0 {
+		patterns = []string{"**"}
+	}
+
+	filtered := []Change{}
+	for _, c := range changes {
+		if len(p.ChangeStatuses) == 0 || slices.Contains(p.ChangeStatuses, c.Status) {
+			filtered = append(filtered, c)
+		}
+	}
+	return Match(changedPaths(filtered), patterns...)
+}
+
+// validatePattern reports whether `pattern` is a valid glob of the ones
+// accepted by `Match`.
+func validatePattern(pattern string) error {
+	depth := 0
+	for _, c := range pattern {
+		switch c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+		if depth < 0 {
+			return fmt.Errorf("unbalanced braces in %q", pattern)
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced braces in %q", pattern)
+	}
+
+	for _, segment := range strings.Split(pattern, "/") {
+		// alternatives are not supported by `path.Match`
+		segment = strings.NewReplacer("{", "", "}", "", ",", "").Replace(segment)
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestParseNameStatus(t *testing.T) {
+	changes, err := parseNameStatus("A\x00new.go\x00D\x00old.go\x00M\x00main.go\x00R087\x00a b.go\x00c.go\x00")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{
+		{Path: "new.go", Status: ChangeAdded},
+		{Path: "old.go", Status: ChangeDeleted},
+		{Path: "main.go", Status: ChangeModified},
+		{Path: "c.go", OldPath: "a b.go", Status: ChangeRenamed},
+	})
+
+	changes, err = parseNameStatus("")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{})
+}
@@ -0,0 +1,370 @@
+package pocketci
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Condition is a boolean expression evaluated against an event to decide
+// whether a pipeline runs, e.g. `labels contains "deploy" && branch == "main"`.
+//
+// Expressions compare the variables of the event with string literals using
+// `==`, `!=`, `contains` (a list has an element or a string has a substring)
+// and `matches` (a string, or any element of a list, matches a glob). They are
+// combined with `&&`, `||`, `!` and parentheses. The variables are:
+//
+//   - event: the type of the event, `push` or `pull_request`.
+//   - action: the action of a pull request, e.g. `opened`.
+//   - branch: the pushed branch or the head branch of a pull request.
+//   - base_branch: the base branch of a pull request.
+//   - labels: the labels of a pull request.
+//   - author: the user who opened the pull request or pushed.
+//   - changes: the paths of the files that changed.
+//   - message: the head commit message of a push or the title and body of a
+//     pull request.
+type Condition struct {
+	expr string
+	root conditionNode
+}
+
+type conditionType int
+
+const (
+	conditionString conditionType = iota
+	conditionList
+	conditionBool
+)
+
+func (t conditionType) String() string {
+	switch t {
+	case conditionString:
+		return "string"
+	case conditionList:
+		return "list"
+	default:
+		return "bool"
+	}
+}
+
+// conditionVariables are the variables of conditions and their types.
+var conditionVariables = map[string]conditionType{
+	"event":       conditionString,
+	"action":      conditionString,
+	"branch":      conditionString,
+	"base_branch": conditionString,
+	"labels":      conditionList,
+	"author":      conditionString,
+	"changes":     conditionList,
+	"message":     conditionString,
+}
+
+// ParseCondition parses and type checks `expr`.
+func ParseCondition(expr string) (*Condition, error) {
+	p := &conditionParser{expr: expr}
+	if err := p.tokenize(); err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", expr, err)
+	}
+
+	root, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	if err == nil && root.typ() != conditionBool {
+		err = fmt.Errorf("expression is a %s, not a bool", root.typ())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %w", expr, err)
+	}
+	return &Condition{expr: expr, root: root}, nil
+}
+
+func (c *Condition) String() string {
+	return c.expr
+}
+
+// Eval reports whether the condition holds for `event`.
+func (c *Condition) Eval(event *GithubEvent) bool {
+	return c.root.eval(conditionEnv(event)).(bool)
+}
+
+// conditionEnv returns the values of the variables of conditions for `event`.
+func conditionEnv(event *GithubEvent) map[string]any {
+	env := map[string]any{
+		"event":       event.EventType,
+		"action":      "",
+		"branch":      event.Branch,
+		"base_branch": event.BaseBranch,
+		"labels":      []string{},
+		"author":      "",
+		"changes":     changedPaths(event.Changes),
+		"message":     event.Message(),
+	}
+
+	switch {
+	case event.PullRequestEvent != nil:
+		pr := event.PullRequestEvent.GetPullRequest()
+		labels := []string{}
+		for _, label := range pr.Labels {
+			labels = append(labels, label.GetName())
+		}
+		env["action"] = event.PullRequestEvent.GetAction()
+		env["labels"] = labels
+		env["author"] = pr.GetUser().GetLogin()
+	case event.PushEvent != nil:
+		env["author"] = event.PushEvent.GetSender().GetLogin()
+	}
+	return env
+}
+
+type conditionNode interface {
+	typ() conditionType
+	eval(env map[string]any) any
+}
+
+type conditionLiteral string
+
+func (l conditionLiteral) typ() conditionType          { return conditionString }
+func (l conditionLiteral) eval(env map[string]any) any { return string(l) }
+
+type conditionVariable string
+
+func (v conditionVariable) typ() conditionType          { return conditionVariables[string(v)] }
+func (v conditionVariable) eval(env map[string]any) any { return env[string(v)] }
+
+type conditionNot struct{ operand conditionNode }
+
+func (n conditionNot) typ() conditionType { return conditionBool }
+func (n conditionNot) eval(env map[string]any) any {
+	return !n.operand.eval(env).(bool)
+}
+
+type conditionBinary struct {
+	op          string
+	left, right conditionNode
+}
+
+func (b conditionBinary) typ() conditionType { return conditionBool }
+
+func (b conditionBinary) eval(env map[string]any) any {
+	// && and || short circuit
+	switch b.op {
+	case "&&":
+		return b.left.eval(env).(bool) && b.right.eval(env).(bool)
+	case "||":
+		return b.left.eval(env).(bool) || b.right.eval(env).(bool)
+	}
+
+	left, right := b.left.eval(env), b.right.eval(env).(string)
+	switch b.op {
+	case "==":
+		return left.(string) == right
+	case "!=":
+		return left.(string) != right
+	case "contains":
+		if list, ok := left.([]string); ok {
+			return slices.Contains(list, right)
+		}
+		return strings.Contains(left.(string), right)
+	default: // matches
+		if list, ok := left.([]string); ok {
+			return Match(list, right)
+		}
+		return Match([]string{left.(string)}, right)
+	}
+}
+
+type conditionToken struct {
+	text string
+	pos  int
+	// literal is set for string literals, whose text is unquoted.
+	literal bool
+}
+
+func (t conditionToken) String() string {
+	if t.literal {
+		return fmt.Sprintf("%q at %d", t.text, t.pos)
+	}
+	return fmt.Sprintf("%s at %d", t.text, t.pos)
+}
+
+type conditionParser struct {
+	expr   string
+	tokens []conditionToken
+	pos    int
+}
+
+func (p *conditionParser) tokenize() error {
+	for i := 0; i < len(p.expr); {
+		c := rune(p.expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"':
+			end := i + 1
+			for ; end < len(p.expr) && p.expr[end] != '"'; end++ {
+				if p.expr[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(p.expr) {
+				return fmt.Errorf("unterminated string at %d", i)
+			}
+			text, err := strconv.Unquote(p.expr[i : end+1])
+			if err != nil {
+				return fmt.Errorf("invalid string at %d", i)
+			}
+			p.tokens = append(p.tokens, conditionToken{text: text, pos: i, literal: true})
+			i = end + 1
+		case c == '_' || unicode.IsLetter(c):
+			end := i
+			for end < len(p.expr) && (p.expr[end] == '_' || unicode.IsLetter(rune(p.expr[end])) || unicode.IsDigit(rune(p.expr[end]))) {
+				end++
+			}
+			p.tokens = append(p.tokens, conditionToken{text: p.expr[i:end], pos: i})
+			i = end
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "&&", "||", "!", "(", ")"} {
+				if strings.HasPrefix(p.expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			p.tokens = append(p.tokens, conditionToken{text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return nil
+}
+
+// next returns the next token without consuming it.
+func (p *conditionParser) next() (conditionToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return conditionToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// accept consumes the next token if it is the operator or keyword `text`.
+func (p *conditionParser) accept(text string) bool {
+	if t, ok := p.next(); ok && !t.literal && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	return p.parseLogical("&&", p.parseNot)
+}
+
+func (p *conditionParser) parseLogical(op string, operand func() (conditionNode, error)) (conditionNode, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(op) {
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range []conditionNode{left, right} {
+			if n.typ() != conditionBool {
+				return nil, fmt.Errorf("operands of %s must be bools, got a %s", op, n.typ())
+			}
+		}
+		left = conditionBinary{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseNot() (conditionNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if operand.typ() != conditionBool {
+			return nil, fmt.Errorf("operand of ! must be a bool, got a %s", operand.typ())
+		}
+		return conditionNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *conditionParser) parseComparison() (conditionNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := p.next()
+	if !ok || t.literal || !slices.Contains([]string{"==", "!=", "contains", "matches"}, t.text) {
+		return left, nil
+	}
+	p.pos++
+
+	right, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if right.typ() != conditionString {
+		return nil, fmt.Errorf("right operand of %s must be a string, got a %s", t.text, right.typ())
+	}
+
+	switch {
+	case (t.text == "==" || t.text == "!=") && left.typ() != conditionString:
+		return nil, fmt.Errorf("left operand of %s must be a string, got a %s", t.text, left.typ())
+	case left.typ() == conditionBool:
+		return nil, fmt.Errorf("left operand of %s must be a string or a list, got a bool", t.text)
+	}
+	if pattern, ok := right.(conditionLiteral); ok && t.text == "matches" {
+		if err := validatePattern(string(pattern)); err != nil {
+			return nil, err
+		}
+	}
+	return conditionBinary{op: t.text, left: left, right: right}, nil
+}
+
+func (p *conditionParser) parsePrimary() (conditionNode, error) {
+	t, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case t.literal:
+		return conditionLiteral(t.text), nil
+	case t.text == "(":
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			if t, ok := p.next(); ok {
+				return nil, fmt.Errorf("expected ) but got %s", t)
+			}
+			return nil, fmt.Errorf("expected ) at the end of expression")
+		}
+		return n, nil
+	}
+
+	if _, ok := conditionVariables[t.text]; ok {
+		return conditionVariable(t.text), nil
+	}
+	if t.text != "" && (t.text[0] == '_' || unicode.IsLetter(rune(t.text[0]))) {
+		return nil, fmt.Errorf("unknown variable %s", t)
+	}
+	return nil, fmt.Errorf("unexpected %s", t)
+}
@@ -0,0 +1,106 @@
+package pocketci
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v61/github"
+	"gotest.tools/v3/assert"
+)
+
+func TestParseCondition(t *testing.T) {
+	cases := []struct {
+		name string
+		expr string
+		err  string
+	}{
+		{name: "comparison", expr: `branch == "main"`},
+		{name: "logical operators", expr: `!(event == "push" || labels contains "skip") && changes matches "**/*.go"`},
+		{name: "escaped quote", expr: `message contains "\"wip\""`},
+		{name: "variable operands", expr: `branch != base_branch`},
+		{
+			name: "unknown variable",
+			expr: `tag == "v1"`,
+			err:  `invalid condition "tag == \"v1\"": unknown variable tag at 0`,
+		},
+		{
+			name: "not a bool",
+			expr: `branch`,
+			err:  `invalid condition "branch": expression is a string, not a bool`,
+		},
+		{
+			name: "list equality",
+			expr: `labels == "deploy"`,
+			err:  `invalid condition "labels == \"deploy\"": left operand of == must be a string, got a list`,
+		},
+		{
+			name: "string operand of &&",
+			expr: `branch == "main" && author`,
+			err:  `invalid condition "branch == \"main\" && author": operands of && must be bools, got a string`,
+		},
+		{
+			name: "unterminated string",
+			expr: `branch == "main`,
+			err:  `invalid condition "branch == \"main": unterminated string at 10`,
+		},
+		{
+			name: "missing parenthesis",
+			expr: `(branch == "main"`,
+			err:  `invalid condition "(branch == \"main\"": expected ) at the end of expression`,
+		},
+		{
+			name: "trailing tokens",
+			expr: `branch == "main" "dev"`,
+			err:  `invalid condition "branch == \"main\" \"dev\"": unexpected "dev" at 17`,
+		},
+		{
+			name: "invalid glob",
+			expr: `changes matches "src/[a-"`,
+			err:  `invalid condition "changes matches \"src/[a-\"": invalid pattern "src/[a-": syntax error in pattern`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseCondition(tc.expr)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+		})
+	}
+}
+
+func TestConditionEval(t *testing.T) {
+	pr, err := parseGithubEvent(GithubPullRequest, ghPrOpen)
+	assert.NilError(t, err)
+	pr.PullRequestEvent.PullRequest.Labels = []*github.Label{{Name: github.String("deploy")}}
+	pr.Changes = []Change{{Path: "docs/index.md", Status: ChangeModified}}
+
+	push, err := parseGithubEvent(GithubPush, ghCommitPush)
+	assert.NilError(t, err)
+
+	cases := []struct {
+		name     string
+		event    *GithubEvent
+		expr     string
+		expected bool
+	}{
+		{name: "label and base branch", event: pr, expr: `labels contains "deploy" && base_branch == "main"`, expected: true},
+		{name: "missing label", event: pr, expr: `labels contains "release"`, expected: false},
+		{name: "push has no labels", event: push, expr: `labels contains "deploy"`, expected: false},
+		{name: "event and action", event: pr, expr: `event == "pull_request" && action == "opened"`, expected: true},
+		{name: "push branch", event: push, expr: `event == "push" && branch matches "ma*"`, expected: true},
+		{name: "author", event: push, expr: `author == "matipan"`, expected: true},
+		{name: "changes", event: pr, expr: `!(changes matches "**/*.go")`, expected: true},
+		{name: "message", event: push, expr: `message contains "Initial" || branch == "dev"`, expected: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cond, err := ParseCondition(tc.expr)
+			assert.NilError(t, err)
+			assert.Equal(t, cond.Eval(tc.event), tc.expected)
+		})
+	}
+}
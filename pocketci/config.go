@@ -0,0 +1,197 @@
+package pocketci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file shared by the server and the agents.
+type Config struct {
+	// Credentials are checked in order, the first one that matches a
+	// repository is used to fetch it.
+	Credentials []CredentialConfig `yaml:"credentials"`
+	// Secrets configures the backends of the secrets of specs on top of the
+	// environment.
+	Secrets SecretsConfig `yaml:"secrets"`
+	// Variables are injected into every pipeline, see `Variables`.
+	Variables Variables `yaml:"variables"`
+	// Agents configures how agents authenticate against the server.
+	Agents AgentsConfig `yaml:"agents"`
+}
+
+// DefaultAgentTokenEnv is the environment variable the agent token is read
+// from when the config doesn't name one.
+const DefaultAgentTokenEnv = "POCKETCI_AGENT_TOKEN"
+
+// AgentsConfig configures the token shared by the server and its agents. The
+// token is always read from the environment.
+type AgentsConfig struct {
+	// TokenEnv defaults to `DefaultAgentTokenEnv`.
+	TokenEnv string `yaml:"token-env"`
+}
+
+// SecretsConfig configures the secret backends. Backends that are not
+// configured are disabled.
+type SecretsConfig struct {
+	// Env are the environment variables, on top of the ones prefixed with
+	// `EnvSecretPrefix`, that `from-env` secrets can be read from.
+	Env []string `yaml:"env"`
+	// FilesDir is the directory of the `from-file` secrets.
+	FilesDir string             `yaml:"files-dir"`
+	Store    *SecretStoreConfig `yaml:"store"`
+	Sops     *SopsConfig        `yaml:"sops"`
+}
+
+// SecretStoreConfig configures the HTTP secret store. The token is always read
+// from the environment.
+type SecretStoreConfig struct {
+	URL      string `yaml:"url"`
+	TokenEnv string `yaml:"token-env"`
+}
+
+type SopsConfig struct {
+	AgeKeyFile string   `yaml:"age-key-file"`
+	Command    []string `yaml:"command"`
+}
+
+// CredentialConfig configures the credentials of the repositories matching
+// `Host` and `Repository`. Exactly one of `Netrc`, `SSHKey` and `Token` has to
+// be set.
+type CredentialConfig struct {
+	Host       string `yaml:"host"`
+	Repository string `yaml:"repository"`
+
+	Netrc  *NetrcConfig  `yaml:"netrc"`
+	SSHKey *SSHKeyConfig `yaml:"ssh-key"`
+	Token  *TokenConfig  `yaml:"token"`
+}
+
+// NetrcConfig configures static basic auth credentials. The password is always
+// read from the environment.
+type NetrcConfig struct {
+	Username    string `yaml:"username"`
+	UsernameEnv string `yaml:"username-env"`
+	PasswordEnv string `yaml:"password-env"`
+}
+
+type SSHKeyConfig struct {
+	Path       string `yaml:"path"`
+	KnownHosts string `yaml:"known-hosts"`
+	User       string `yaml:"user"`
+}
+
+type TokenConfig struct {
+	Username string        `yaml:"username"`
+	Command  []string      `yaml:"command"`
+	TTL      time.Duration `yaml:"ttl"`
+}
+
+// LoadConfig reads the configuration file at `path`. Unknown fields are
+// reported as errors so typos don't go unnoticed.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if err := config.Variables.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// CredentialProvider returns the provider of the configured credentials. When
+// none are configured github.com is accessed with the GITHUB_USERNAME and
+// GITHUB_TOKEN environment variables.
+func (c *Config) CredentialProvider() (CredentialProvider, error) {
+	if len(c.Credentials) == 0 {
+		return &GitCredentials{
+			Host:     "github.com",
+			Username: os.Getenv("GITHUB_USERNAME"),
+			Password: os.Getenv("GITHUB_TOKEN"),
+		}, nil
+	}
+
+	rules := CredentialRules{}
+	for i, cred := range c.Credentials {
+		rule := CredentialRule{Host: cred.Host, Repository: cred.Repository}
+
+		configured := 0
+		if cred.Netrc != nil {
+			username := cred.Netrc.Username
+			if cred.Netrc.UsernameEnv != "" {
+				username = os.Getenv(cred.Netrc.UsernameEnv)
+			}
+			rule.Provider = &GitCredentials{Host: cred.Host, Username: username, Password: os.Getenv(cred.Netrc.PasswordEnv)}
+			configured++
+		}
+		if cred.SSHKey != nil {
+			if cred.SSHKey.Path == "" {
+				return nil, fmt.Errorf("credentials %d: ssh-key path is required", i)
+			}
+			rule.Provider = &SSHKey{Path: cred.SSHKey.Path, KnownHosts: cred.SSHKey.KnownHosts, User: cred.SSHKey.User}
+			configured++
+		}
+		if cred.Token != nil {
+			if len(cred.Token.Command) == 0 {
+				return nil, fmt.Errorf("credentials %d: token command is required", i)
+			}
+			rule.Provider = &TokenCredentials{Host: cred.Host, Username: cred.Token.Username, Command: cred.Token.Command, TTL: cred.Token.TTL}
+			configured++
+		}
+
+		if configured != 1 {
+			return nil, fmt.Errorf("credentials %d: exactly one of netrc, ssh-key or token must be set", i)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// AgentToken returns the token agents authenticate with. It is required as
+// agents receive the secrets of the pipelines they run.
+func (c *Config) AgentToken() (string, error) {
+	env := c.Agents.TokenEnv
+	if env == "" {
+		env = DefaultAgentTokenEnv
+	}
+
+	token := os.Getenv(env)
+	if token == "" {
+		return "", fmt.Errorf("agents: the agent token must be set in %s", env)
+	}
+	return token, nil
+}
+
+// SecretBackends returns the configured secret backends. Secrets can always be
+// read from the environment.
+func (c *Config) SecretBackends() (*SecretBackends, error) {
+	backends := DefaultSecretBackends()
+	backends.Env = EnvSecrets{Allowed: c.Secrets.Env}
+	if c.Secrets.FilesDir != "" {
+		backends.File = &FileSecrets{Dir: c.Secrets.FilesDir}
+	}
+	if store := c.Secrets.Store; store != nil {
+		if store.URL == "" {
+			return nil, errors.New("secrets: store url is required")
+		}
+		backends.Store = &HTTPSecretStore{URL: store.URL, Token: os.Getenv(store.TokenEnv)}
+	}
+	if sops := c.Secrets.Sops; sops != nil {
+		backends.Sops = &SopsSecrets{AgeKeyFile: sops.AgeKeyFile, Command: sops.Command}
+	}
+	return backends, nil
+}
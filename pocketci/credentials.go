@@ -0,0 +1,220 @@
+package pocketci
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar"
+)
+
+// CredentialProvider provides the credentials git uses to fetch repositories.
+type CredentialProvider interface {
+	// Env returns the environment that authenticates the git commands run
+	// for `repoURL`. Configuration is passed through the environment so it
+	// is never persisted nor visible in the list of processes.
+	Env(ctx context.Context, repoURL string) ([]string, error)
+}
+
+// GitCredentials are static basic auth credentials used for git over https,
+// the equivalent of a netrc entry.
+type GitCredentials struct {
+	// Host the credentials are sent to. Defaults to the host of the
+	// repository being fetched.
+	Host     string
+	Username string
+	Password string
+}
+
+func (c *GitCredentials) Env(ctx context.Context, repoURL string) ([]string, error) {
+	return c.env(repoURL), nil
+}
+
+// env returns the git configuration that authenticates the https requests of
+// `repoURL` using the credentials. It is scoped to the host of the
+// credentials so they are not leaked to other hosts, e.g. when fetching
+// submodules.
+func (c *GitCredentials) env(repoURL string) []string {
+	if c == nil || (c.Username == "" && c.Password == "") {
+		return nil
+	}
+
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Scheme != "https" {
+		return nil
+	}
+
+	host := c.Host
+	if host == "" {
+		host = u.Host
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=http.https://%s/.extraHeader", host),
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + auth,
+	}
+}
+
+// SSHKey authenticates with a private key, usually a deploy key of a single
+// repository. Requests for the repository are made over ssh instead of https.
+type SSHKey struct {
+	// Path of the private key.
+	Path string
+	// KnownHosts is the path of the known hosts file used to verify the
+	// host. Hosts are trusted on first use when empty.
+	KnownHosts string
+	// User is the ssh user. Defaults to `git`.
+	User string
+}
+
+func (k *SSHKey) Env(ctx context.Context, repoURL string) ([]string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository url %s: %w", repoURL, err)
+	}
+	if u.Scheme != "https" {
+		return nil, nil
+	}
+
+	user := k.User
+	if user == "" {
+		user = "git"
+	}
+
+	command := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new", shellQuote(k.Path))
+	if k.KnownHosts != "" {
+		command = fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile=%s",
+			shellQuote(k.Path), shellQuote(k.KnownHosts))
+	}
+
+	// mirrors are keyed by their https url so it is rewritten to ssh. Urls
+	// are rewritten by prefix, the origin of mirrors ends in `.git` to only
+	// match this repository
+	path := strings.TrimSuffix(u.Path, ".git") + ".git"
+	return []string{
+		"GIT_SSH_COMMAND=" + command,
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=url.ssh://%s@%s%s.insteadOf", user, u.Host, path),
+		"GIT_CONFIG_VALUE_0=" + originURL(repoURL),
+	}, nil
+}
+
+// TokenCredentials authenticates over https with short-lived tokens printed
+// by `Command`, e.g. a script that issues GitHub App installation tokens.
+// Tokens are reused until they are about to expire.
+type TokenCredentials struct {
+	// Host the token is sent to. Defaults to the host of the repository
+	// being fetched.
+	Host string
+	// Username sent along the token. Defaults to `x-access-token`.
+	Username string
+	Command  []string
+	// TTL is how long tokens are valid for. Tokens are not reused when zero.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *TokenCredentials) Env(ctx context.Context, repoURL string) ([]string, error) {
+	token, err := t.getToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	username := t.Username
+	if username == "" {
+		username = "x-access-token"
+	}
+
+	creds := &GitCredentials{Host: t.Host, Username: username, Password: token}
+	return creds.env(repoURL), nil
+}
+
+func (t *TokenCredentials) getToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != "" && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	if len(t.Command) == 0 {
+		return "", errors.New("token command is not configured")
+	}
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("token command failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(stdout.String())
+	if token == "" {
+		return "", errors.New("token command did not print a token")
+	}
+
+	// tokens are renewed ahead of time so they remain valid for every git
+	// command of an event
+	t.token = token
+	t.expires = time.Now().Add(t.TTL * 9 / 10)
+	return token, nil
+}
+
+// CredentialRule selects the provider of the repositories of `Host` whose
+// full name matches `Repository`.
+type CredentialRule struct {
+	// Host of the repositories, any host when empty.
+	Host string
+	// Repository is a glob matched against the full name of repositories,
+	// e.g. `franela/*`. Any repository when empty.
+	Repository string
+	Provider   CredentialProvider
+}
+
+// CredentialRules uses the provider of the first rule that matches each
+// repository, so more specific rules should come first. Repositories that
+// don't match any rule are fetched without credentials.
+type CredentialRules []CredentialRule
+
+func (r CredentialRules) Env(ctx context.Context, repoURL string) ([]string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository url %s: %w", repoURL, err)
+	}
+	name := strings.Trim(strings.TrimSuffix(u.Path, ".git"), "/")
+
+	for _, rule := range r {
+		if rule.Host != "" && rule.Host != u.Host {
+			continue
+		}
+		if rule.Repository != "" {
+			match, err := doublestar.Match(rule.Repository, name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid repository pattern %s: %w", rule.Repository, err)
+			}
+			if !match {
+				continue
+			}
+		}
+		return rule.Provider.Env(ctx, repoURL)
+	}
+
+	return nil, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
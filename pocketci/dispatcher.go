@@ -2,29 +2,68 @@ package pocketci
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Dispatcher receives a list of functions and is in charge of making sure
 // each function call happens at most once. Whether they happen sync or async
 // is up to the implementation.
-// NOTE: if we eventually want to support remote function calls through a queue
-// sort of system this interface (and the whole clone approach) will likely have
-// to change. We can't really package the dagger.Directory of the repository through
-// a queue so that would mean the dispatcher would have to re-clone the repo.
-// Not a huge deal, but probably worth to spend some time and think how this could
-// be re-architected.
+// NOTE: a dagger.Directory of the repository can't travel through a queue, so
+// pipelines reference a snapshot of their tree served by the server (see
+// `Snapshots`) that agents download. Without snapshots agents re-clone the repo.
 type Dispatcher interface {
 	Dispatch(ctx context.Context, gitInfo GitInfo, pipelines []*Pipeline) error
 	GetPipeline(ctx context.Context, runner string) *PocketciPipeline
-	PipelineDone(ctx context.Context, id int) error
+	// PipelineDone records how the attempt `attempt` of the pipeline
+	// identified by `id` ended. Failed pipelines are queued again according
+	// to their retry policy, and the pipelines that run after them only run
+	// once they succeed. Reports of attempts that are no longer running, e.g.
+	// because they timed out, fail with `ErrStaleAttempt`.
+	PipelineDone(ctx context.Context, id, attempt int, status PipelineStatus, logs string) error
+	// PipelineStarted records that the call of the attempt `attempt` of the
+	// pipeline identified by `id` started, after its agent checked out the
+	// repository. Its timeout counts from then.
+	PipelineStarted(ctx context.Context, id, attempt int) error
+	// Attempts returns every attempt of the pipeline identified by `id`.
+	Attempts(ctx context.Context, id int) ([]PipelineAttempt, error)
+	// Cancelled reports whether the attempt `attempt` of the pipeline
+	// identified by `id` has to be stopped by its agent: the pipeline was
+	// cancelled by a newer run of its concurrency group, or the attempt is no
+	// longer running.
+	Cancelled(ctx context.Context, id, attempt int) (bool, error)
+	// TimeOut marks the running pipelines that outlived their timeout by more
+	// than `TimeoutGrace` at `now` as timed out, so a hung or lost agent
+	// doesn't keep them running forever. Like any other failure, timeouts are
+	// retried according to the retry policy. It returns the timed out
+	// pipelines.
+	TimeOut(ctx context.Context, now time.Time) []*PocketciPipeline
+	// MarkStale flags the pipelines of `repository` that tested the merge of
+	// a pull request against `baseBranch` when it was at a commit other than
+	// `baseSHA`. It returns the flagged pipelines.
+	MarkStale(ctx context.Context, repository, baseBranch, baseSHA string) []*PocketciPipeline
+	// PendingSnapshots returns the digests of the snapshots of the queued and
+	// running pipelines, which agents might still download.
+	PendingSnapshots(ctx context.Context) map[string]bool
 }
 
+// TimeoutGrace is how long past the timeout of a pipeline its agent has to
+// report it before the server marks it as timed out. Agents enforce the
+// timeout on the call itself, the grace covers reporting it.
+const TimeoutGrace = time.Minute
+
+// ErrStaleAttempt is returned for the reports of attempts that are no longer
+// running.
+var ErrStaleAttempt = errors.New("the attempt of the pipeline is no longer running")
+
 // LocalDispatcher makes each of the function calls directly on the host.
 type LocalDispatcher struct {
 	queuedMu sync.RWMutex
@@ -37,6 +76,9 @@ type LocalDispatcher struct {
 	done   map[int]*PocketciPipeline
 
 	lastID atomic.Int64
+	// lastBatch identifies the pipelines of each call to `Dispatch`, newer
+	// runs have greater batches.
+	lastBatch atomic.Int64
 }
 
 func NewLocalDispatcher() *LocalDispatcher {
@@ -56,10 +98,60 @@ type PocketciPipeline struct {
 	Runner     string   `json:"runner"`
 	Changes    []string `json:"changes"`
 	Module     string   `json:"module"`
+	MergeRef   bool     `json:"merge_ref"`
+	Paths      []string `json:"paths"`
+	// Snapshot is the digest of the snapshot, served by the server, with the
+	// tree to run the pipeline on. Agents check out the repository when empty.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Secrets are the values of the secrets the call can use by name. They
+	// are only sent to the agents that claim the pipeline.
+	Secrets map[string]string `json:"secrets,omitempty"`
+	// Variables are the non-secret environment variables of the call.
+	Variables map[string]string `json:"variables,omitempty"`
+	// Matrix is the combination of the matrix the job runs with.
+	Matrix map[string]string `json:"matrix,omitempty"`
+	// Timeout is the longest the call can run. There is no limit when zero.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// StartedAt is when the call of the current attempt started, or when the
+	// pipeline was claimed until its agent reports it.
+	StartedAt time.Time `json:"started_at"`
+	// Attempt is the number of the current attempt, starting at 1. Agents
+	// send it along their reports so the ones of previous attempts are
+	// ignored.
+	Attempt int `json:"attempt"`
+	// Status is how the pipeline ended, empty until it is done.
+	Status PipelineStatus `json:"status,omitempty"`
+	// Attempts are the runs of the pipeline so far, with their logs.
+	Attempts []PipelineAttempt `json:"-"`
+	// NeedsRerun is set when the pipeline tested the merge of a pull request
+	// and its base branch moved afterwards.
+	NeedsRerun bool `json:"needs_rerun"`
+	// Concurrency is the rendered concurrency group of the pipeline, prefixed
+	// with its repository so groups of different repositories don't collide.
+	Concurrency string `json:"concurrency,omitempty"`
+	// Cancelled is set on running pipelines cancelled by a newer run of
+	// their concurrency group until their agent stops them.
+	Cancelled bool `json:"cancelled"`
 
-	pipelineDeps []string
+	pipelineDeps     []string
+	retry            *RetryPolicy
+	backoff          time.Duration
+	cancelInProgress bool
+	batch            int64
+	// retryAt is when a failed pipeline can be claimed again.
+	retryAt time.Time
+
+	GitInfo      GitInfo         `json:"git_info"`
+	EventTrigger json.RawMessage `json:"event_trigger"`
+}
 
-	GitInfo GitInfo `json:"git_info"`
+// PipelineAttempt is a single run of a pipeline. Pipelines run more than once
+// when they are retried.
+type PipelineAttempt struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Status     PipelineStatus `json:"status"`
+	Logs       string         `json:"logs"`
 }
 
 func (ld *LocalDispatcher) GetPipeline(ctx context.Context, runner string) *PocketciPipeline {
@@ -81,11 +173,23 @@ func (ld *LocalDispatcher) getPipeline(ctx context.Context, runner string, id in
 		return ld.getPipeline(ctx, runner, id+1)
 	}
 
+	if time.Now().Before(pipeline.retryAt) {
+		ld.queuedMu.Unlock()
+		return ld.getPipeline(ctx, runner, id+1)
+	}
+
+	// pipelines of a concurrency group run one at a time, in the order of
+	// their runs
+	if pipeline.Concurrency != "" && (ld.groupRunning(pipeline.Concurrency) || ld.groupQueuedBefore(pipeline)) {
+		ld.queuedMu.Unlock()
+		return ld.getPipeline(ctx, runner, id+1)
+	}
+
 	ld.doneMu.RLock()
 	allDone := true
 	for _, parent := range pipeline.Parents {
-		_, ok := ld.done[parent]
-		allDone = allDone && ok
+		p, ok := ld.done[parent]
+		allDone = allDone && ok && p.Status == PipelineSucceeded
 	}
 	ld.doneMu.RUnlock()
 
@@ -94,45 +198,279 @@ func (ld *LocalDispatcher) getPipeline(ctx context.Context, runner string, id in
 		return ld.getPipeline(ctx, runner, id+1)
 	}
 
-	switch id {
-	case 0:
-		ld.queued = ld.queued[1:]
-	case len(ld.queued):
-		ld.queued = ld.queued[:id]
-	default:
-		ld.queued = ld.queued[0:id]
-		ld.queued = ld.queued[id:]
-	}
-	ld.queuedMu.Unlock()
-
+	// the pipeline is running before the queue is unlocked so no other
+	// pipeline of its concurrency group is claimed meanwhile
+	ld.queued = slices.Delete(ld.queued, id, id+1)
 	ld.runningMu.Lock()
+	pipeline.StartedAt = time.Now()
+	pipeline.Attempt = len(pipeline.Attempts) + 1
 	ld.running[pipeline.ID] = pipeline
 	ld.runningMu.Unlock()
+	ld.queuedMu.Unlock()
 	return pipeline
 }
 
-func (ld *LocalDispatcher) PipelineDone(ctx context.Context, id int) error {
+func (ld *LocalDispatcher) groupRunning(group string) bool {
+	ld.runningMu.RLock()
+	defer ld.runningMu.RUnlock()
+
+	for _, p := range ld.running {
+		if p.Concurrency == group {
+			return true
+		}
+	}
+	return false
+}
+
+// groupQueuedBefore reports whether a pipeline of the concurrency group of
+// `pipeline` was queued by an earlier run, e.g. the retry of a failed one. The
+// queue must be locked.
+func (ld *LocalDispatcher) groupQueuedBefore(pipeline *PocketciPipeline) bool {
+	return slices.ContainsFunc(ld.queued, func(p *PocketciPipeline) bool {
+		return p.Concurrency == pipeline.Concurrency && p.batch < pipeline.batch
+	})
+}
+
+func (ld *LocalDispatcher) PipelineDone(ctx context.Context, id, attempt int, status PipelineStatus, logs string) error {
 	ld.runningMu.Lock()
 	pipeline, ok := ld.running[id]
-	if !ok {
+	if !ok || pipeline.Attempt != attempt {
 		ld.runningMu.Unlock()
-		return errors.New("pipeline not found")
+		return ErrStaleAttempt
 	}
 
+	// whatever the agent reports, the pipeline was stopped because it was
+	// cancelled
+	if pipeline.Cancelled {
+		status = PipelineCancelled
+	}
 	delete(ld.running, id)
 	ld.runningMu.Unlock()
 
-	ld.doneMu.Lock()
-	ld.done[id] = pipeline
-	ld.doneMu.Unlock()
+	ld.finish(pipeline, status, RedactSecrets(logs, pipeline.Secrets), time.Now())
+	return nil
+}
 
+func (ld *LocalDispatcher) PipelineStarted(ctx context.Context, id, attempt int) error {
+	ld.runningMu.Lock()
+	defer ld.runningMu.Unlock()
+
+	pipeline, ok := ld.running[id]
+	if !ok || pipeline.Attempt != attempt {
+		return ErrStaleAttempt
+	}
+	pipeline.StartedAt = time.Now()
 	return nil
 }
 
+func (ld *LocalDispatcher) TimeOut(ctx context.Context, now time.Time) []*PocketciPipeline {
+	ld.runningMu.Lock()
+	timedOut := []*PocketciPipeline{}
+	for id, p := range ld.running {
+		if p.Timeout > 0 && now.After(p.StartedAt.Add(p.Timeout+TimeoutGrace)) {
+			delete(ld.running, id)
+			timedOut = append(timedOut, p)
+		}
+	}
+	ld.runningMu.Unlock()
+
+	for _, p := range timedOut {
+		ld.finish(p, PipelineTimedOut, "", now)
+	}
+	return timedOut
+}
+
+// finish records the attempt of `pipeline` that ended with `status` at `now`.
+// The pipeline is queued again while its retry policy allows it, otherwise
+// it is done and, unless it succeeded, the pipelines that run after it are
+// skipped.
+func (ld *LocalDispatcher) finish(pipeline *PocketciPipeline, status PipelineStatus, logs string, now time.Time) {
+	pipeline.Attempts = append(pipeline.Attempts, PipelineAttempt{
+		StartedAt:  pipeline.StartedAt,
+		FinishedAt: now,
+		Status:     status,
+		Logs:       logs,
+	})
+
+	retry := pipeline.retry
+	if retry != nil && len(pipeline.Attempts) <= retry.Retries && retry.retryable(status) {
+		pipeline.retryAt = now.Add(retryBackoff(pipeline.backoff, len(pipeline.Attempts)))
+		slog.Info("retrying pipeline", slog.Int("pipeline", pipeline.ID), slog.String("name", pipeline.Name),
+			slog.String("status", string(status)), slog.Int("attempt", len(pipeline.Attempts)+1),
+			slog.Time("retry_at", pipeline.retryAt))
+
+		ld.queuedMu.Lock()
+		ld.queued = append(ld.queued, pipeline)
+		ld.queuedMu.Unlock()
+		return
+	}
+
+	ld.queuedMu.Lock()
+	defer ld.queuedMu.Unlock()
+	ld.doneMu.Lock()
+	defer ld.doneMu.Unlock()
+
+	pipeline.Status = status
+	ld.done[pipeline.ID] = pipeline
+	if status != PipelineSucceeded {
+		ld.skipDependents(map[int]bool{pipeline.ID: true})
+	}
+}
+
+// skipDependents skips the queued pipelines that run after the `skipped`
+// ones, and the ones that run after those. The caller holds the locks of the
+// queued and done pipelines.
+func (ld *LocalDispatcher) skipDependents(skipped map[int]bool) {
+	for changed := true; changed; {
+		changed = false
+		ld.queued = slices.DeleteFunc(ld.queued, func(p *PocketciPipeline) bool {
+			if !slices.ContainsFunc(p.Parents, func(parent int) bool { return skipped[parent] }) {
+				return false
+			}
+			slog.Info("skipping pipeline", slog.Int("pipeline", p.ID), slog.String("name", p.Name))
+			p.Status = PipelineSkipped
+			ld.done[p.ID] = p
+			skipped[p.ID] = true
+			changed = true
+			return true
+		})
+	}
+}
+
+// cancelGroup cancels the pipelines of `group` dispatched before `batch`.
+// Queued pipelines are dropped and running ones are flagged so their agents
+// stop them. The caller holds every lock.
+func (ld *LocalDispatcher) cancelGroup(group string, batch int64) {
+	cancelled := map[int]bool{}
+	ld.queued = slices.DeleteFunc(ld.queued, func(p *PocketciPipeline) bool {
+		if p.Concurrency != group || p.batch >= batch {
+			return false
+		}
+		slog.Info("cancelling queued pipeline", slog.Int("pipeline", p.ID), slog.String("name", p.Name),
+			slog.String("concurrency", group))
+		p.Status = PipelineCancelled
+		ld.done[p.ID] = p
+		cancelled[p.ID] = true
+		return true
+	})
+	ld.skipDependents(cancelled)
+
+	for _, p := range ld.running {
+		if p.Concurrency == group && p.batch < batch && !p.Cancelled {
+			slog.Info("cancelling running pipeline", slog.Int("pipeline", p.ID), slog.String("name", p.Name),
+				slog.String("concurrency", group))
+			p.Cancelled = true
+		}
+	}
+}
+
+func (ld *LocalDispatcher) Cancelled(ctx context.Context, id, attempt int) (bool, error) {
+	ld.queuedMu.RLock()
+	defer ld.queuedMu.RUnlock()
+	ld.runningMu.RLock()
+	defer ld.runningMu.RUnlock()
+	ld.doneMu.RLock()
+	defer ld.doneMu.RUnlock()
+
+	p, ok := ld.running[id]
+	if ok && p.Attempt == attempt {
+		return p.Cancelled, nil
+	}
+
+	// the attempt is over for the server, e.g. it timed out, so whatever
+	// still runs it has to stop
+	_, done := ld.done[id]
+	queued := slices.ContainsFunc(ld.queued, func(p *PocketciPipeline) bool { return p.ID == id })
+	if ok || done || queued {
+		return true, nil
+	}
+	return false, errors.New("pipeline not found")
+}
+
+func (ld *LocalDispatcher) PendingSnapshots(ctx context.Context) map[string]bool {
+	ld.queuedMu.RLock()
+	defer ld.queuedMu.RUnlock()
+	ld.runningMu.RLock()
+	defer ld.runningMu.RUnlock()
+
+	pending := map[string]bool{}
+	for _, p := range slices.Concat(ld.queued, slices.Collect(maps.Values(ld.running))) {
+		if p.Snapshot != "" {
+			pending[p.Snapshot] = true
+		}
+	}
+	return pending
+}
+
+func (ld *LocalDispatcher) Attempts(ctx context.Context, id int) ([]PipelineAttempt, error) {
+	ld.queuedMu.RLock()
+	defer ld.queuedMu.RUnlock()
+	ld.runningMu.RLock()
+	defer ld.runningMu.RUnlock()
+	ld.doneMu.RLock()
+	defer ld.doneMu.RUnlock()
+
+	pipeline, ok := ld.done[id]
+	if !ok {
+		pipeline, ok = ld.running[id]
+	}
+	if !ok {
+		i := slices.IndexFunc(ld.queued, func(p *PocketciPipeline) bool { return p.ID == id })
+		if i < 0 {
+			return nil, errors.New("pipeline not found")
+		}
+		pipeline = ld.queued[i]
+	}
+	return slices.Clone(pipeline.Attempts), nil
+}
+
+func (ld *LocalDispatcher) MarkStale(ctx context.Context, repository, baseBranch, baseSHA string) []*PocketciPipeline {
+	ld.queuedMu.Lock()
+	defer ld.queuedMu.Unlock()
+	ld.runningMu.Lock()
+	defer ld.runningMu.Unlock()
+	ld.doneMu.Lock()
+	defer ld.doneMu.Unlock()
+
+	pipelines := slices.Clone(ld.queued)
+	for _, p := range ld.running {
+		pipelines = append(pipelines, p)
+	}
+	for _, p := range ld.done {
+		pipelines = append(pipelines, p)
+	}
+
+	stale := []*PocketciPipeline{}
+	for _, p := range pipelines {
+		if p.MergeRef && p.Repository == repository && p.GitInfo.staleMerge(baseBranch, baseSHA) {
+			p.NeedsRerun = true
+			stale = append(stale, p)
+		}
+	}
+	return stale
+}
+
 func (ld *LocalDispatcher) Dispatch(ctx context.Context, gitInfo GitInfo, pipelines []*Pipeline) error {
+	batch := ld.lastBatch.Add(1)
 	cache := map[string][]*PocketciPipeline{}
 	newPipelines := []*PocketciPipeline{}
 	for _, p := range pipelines {
+		var timeout time.Duration
+		if p.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(p.Timeout); err != nil {
+				return fmt.Errorf("pipeline %s: invalid timeout: %w", p.Name, err)
+			}
+		}
+
+		var backoff time.Duration
+		if p.Retry != nil && p.Retry.Backoff != "" {
+			var err error
+			if backoff, err = time.ParseDuration(p.Retry.Backoff); err != nil {
+				return fmt.Errorf("pipeline %s: invalid retry backoff: %w", p.Name, err)
+			}
+		}
+
 		for _, cmd := range p.Exec {
 			cmd = strings.TrimSpace(cmd)
 
@@ -144,8 +482,24 @@ func (ld *LocalDispatcher) Dispatch(ctx context.Context, gitInfo GitInfo, pipeli
 				Runner:       p.Runner,
 				Changes:      p.Changes,
 				Module:       p.Module,
+				MergeRef:     p.MergeRef,
+				Paths:        p.Paths,
+				Snapshot:     p.Snapshot,
+				Secrets:      p.secrets,
+				Variables:    p.variables,
+				Matrix:       p.MatrixValues,
+				Timeout:      timeout,
 				pipelineDeps: p.PipelineDeps,
+				retry:        p.Retry,
+				backoff:      backoff,
+				batch:        batch,
 				GitInfo:      gitInfo,
+				EventTrigger: p.EventTrigger,
+			}
+
+			if p.Concurrency != nil {
+				pci.Concurrency = p.Repository + "/" + p.Concurrency.Group
+				pci.cancelInProgress = p.Concurrency.CancelInProgress
 			}
 
 			if len(cache[p.Name]) == 0 {
@@ -172,6 +526,16 @@ func (ld *LocalDispatcher) Dispatch(ctx context.Context, gitInfo GitInfo, pipeli
 
 	ld.queuedMu.Lock()
 	defer ld.queuedMu.Unlock()
+	ld.runningMu.Lock()
+	defer ld.runningMu.Unlock()
+	ld.doneMu.Lock()
+	defer ld.doneMu.Unlock()
+
+	for _, p := range newPipelines {
+		if p.Concurrency != "" && p.cancelInProgress {
+			ld.cancelGroup(p.Concurrency, batch)
+		}
+	}
 	ld.queued = append(ld.queued, newPipelines...)
 
 	return nil
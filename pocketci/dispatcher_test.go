@@ -0,0 +1,339 @@
+package pocketci
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestLocalDispatcherMarkStale(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+
+	gitInfo := GitInfo{
+		Ref:        "refs/pull/1/merge",
+		BaseBranch: "main",
+		BaseSHA:    "base-sha",
+		MergeRef:   "refs/pull/1/merge",
+		MergeSHA:   "merge-sha",
+	}
+	err := ld.Dispatch(ctx, gitInfo, []*Pipeline{
+		{Name: "test", Exec: []string{"test"}, Repository: "franela/pocketci", MergeRef: true},
+		{Name: "lint", Exec: []string{"lint"}, Repository: "franela/pocketci"},
+		{Name: "other", Exec: []string{"test"}, Repository: "franela/other", MergeRef: true},
+	})
+	assert.NilError(t, err)
+
+	cases := []struct {
+		name       string
+		baseBranch string
+		baseSHA    string
+		expected   []string
+	}{
+		{name: "same base commit", baseBranch: "main", baseSHA: "base-sha", expected: []string{}},
+		{name: "other branch", baseBranch: "develop", baseSHA: "new-sha", expected: []string{}},
+		{name: "base moved", baseBranch: "main", baseSHA: "new-sha", expected: []string{"test"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names := []string{}
+			for _, p := range ld.MarkStale(ctx, "franela/pocketci", tc.baseBranch, tc.baseSHA) {
+				assert.Assert(t, p.NeedsRerun)
+				names = append(names, p.Name)
+			}
+			assert.DeepEqual(t, names, tc.expected)
+		})
+	}
+}
+
+func TestLocalDispatcherTimeOut(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+
+	err := ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+		{Name: "test", Exec: []string{"test"}, Timeout: "10m"},
+		{Name: "lint", Exec: []string{"lint"}},
+	})
+	assert.NilError(t, err)
+
+	test := ld.GetPipeline(ctx, "")
+	assert.Equal(t, test.Timeout, 10*time.Minute)
+	lint := ld.GetPipeline(ctx, "")
+	assert.Equal(t, lint.Timeout, time.Duration(0))
+
+	cases := []struct {
+		name     string
+		after    time.Duration
+		expected []string
+	}{
+		{name: "within the timeout", after: 5 * time.Minute, expected: []string{}},
+		{name: "within the grace", after: 10*time.Minute + TimeoutGrace/2, expected: []string{}},
+		{name: "past the grace", after: 10*time.Minute + 2*TimeoutGrace, expected: []string{"test"}},
+		{name: "already timed out", after: time.Hour, expected: []string{}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names := []string{}
+			for _, p := range ld.TimeOut(ctx, test.StartedAt.Add(tc.after)) {
+				assert.Equal(t, p.Status, PipelineTimedOut)
+				names = append(names, p.Name)
+			}
+			assert.DeepEqual(t, names, tc.expected)
+		})
+	}
+
+	err = ld.PipelineDone(ctx, test.ID, test.Attempt, PipelineSucceeded, "")
+	assert.ErrorIs(t, err, ErrStaleAttempt)
+	assert.NilError(t, ld.PipelineDone(ctx, lint.ID, lint.Attempt, PipelineSucceeded, ""))
+	assert.Equal(t, lint.Status, PipelineSucceeded)
+}
+
+func TestLocalDispatcherRetries(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name     string
+		retry    *RetryPolicy
+		statuses []PipelineStatus
+		expected PipelineStatus
+		publish  PipelineStatus
+	}{
+		{
+			name:     "no retries",
+			statuses: []PipelineStatus{PipelineFailed},
+			expected: PipelineFailed,
+			publish:  PipelineSkipped,
+		},
+		{
+			name:     "succeeds on retry",
+			retry:    &RetryPolicy{Retries: 2},
+			statuses: []PipelineStatus{PipelineFailed, PipelineTimedOut, PipelineSucceeded},
+			expected: PipelineSucceeded,
+		},
+		{
+			name:     "retries exhausted",
+			retry:    &RetryPolicy{Retries: 1},
+			statuses: []PipelineStatus{PipelineInfraError, PipelineFailed},
+			expected: PipelineFailed,
+			publish:  PipelineSkipped,
+		},
+		{
+			name:     "infra errors only",
+			retry:    &RetryPolicy{Retries: 2, InfraOnly: true},
+			statuses: []PipelineStatus{PipelineInfraError, PipelineFailed},
+			expected: PipelineFailed,
+			publish:  PipelineSkipped,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ld := NewLocalDispatcher()
+			err := ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+				{Name: "test", Exec: []string{"test"}, Retry: tc.retry},
+				{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"test"}},
+			})
+			assert.NilError(t, err)
+
+			var test *PocketciPipeline
+			for _, status := range tc.statuses {
+				test = ld.GetPipeline(ctx, "")
+				assert.Equal(t, test.Name, "test")
+				assert.NilError(t, ld.PipelineDone(ctx, test.ID, test.Attempt, status, "logs of "+string(status)))
+			}
+			assert.Equal(t, test.Status, tc.expected)
+
+			attempts, err := ld.Attempts(ctx, test.ID)
+			assert.NilError(t, err)
+			assert.Equal(t, len(attempts), len(tc.statuses))
+			for i, attempt := range attempts {
+				assert.Equal(t, attempt.Status, tc.statuses[i])
+				assert.Equal(t, attempt.Logs, "logs of "+string(tc.statuses[i]))
+			}
+
+			publish := ld.GetPipeline(ctx, "")
+			if tc.publish == PipelineSkipped {
+				assert.Assert(t, publish == nil)
+				return
+			}
+			assert.Equal(t, publish.Name, "publish")
+		})
+	}
+}
+
+func TestLocalDispatcherRetryBackoff(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+
+	err := ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+		{Name: "test", Exec: []string{"test"}, Retry: &RetryPolicy{Retries: 1, Backoff: "1h"}},
+		{Name: "lint", Exec: []string{"lint"}},
+	})
+	assert.NilError(t, err)
+
+	test := ld.GetPipeline(ctx, "")
+	assert.NilError(t, ld.PipelineDone(ctx, test.ID, test.Attempt, PipelineFailed, ""))
+
+	// the retry waits for the backoff, other pipelines don't
+	lint := ld.GetPipeline(ctx, "")
+	assert.Equal(t, lint.Name, "lint")
+	assert.Assert(t, ld.GetPipeline(ctx, "") == nil)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	cases := []struct {
+		backoff  time.Duration
+		attempts int
+		expected time.Duration
+	}{
+		{backoff: 0, attempts: 5, expected: 0},
+		{backoff: 30 * time.Second, attempts: 1, expected: 30 * time.Second},
+		{backoff: 30 * time.Second, attempts: 3, expected: 2 * time.Minute},
+		{backoff: 30 * time.Second, attempts: 8, expected: MaxRetryBackoff},
+		{backoff: time.Second, attempts: 100, expected: MaxRetryBackoff},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s after %d attempts", tc.backoff, tc.attempts), func(t *testing.T) {
+			assert.Equal(t, retryBackoff(tc.backoff, tc.attempts), tc.expected)
+		})
+	}
+}
+
+func TestLocalDispatcherStaleAttempts(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+
+	err := ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+		{Name: "test", Exec: []string{"test"}, Timeout: "10m", Retry: &RetryPolicy{Retries: 1}},
+	})
+	assert.NilError(t, err)
+
+	test := ld.GetPipeline(ctx, "")
+	assert.Equal(t, test.Attempt, 1)
+	claimedAt := test.StartedAt
+
+	// the timeout counts from the start of the call
+	assert.NilError(t, ld.PipelineStarted(ctx, test.ID, 1))
+	assert.Assert(t, !test.StartedAt.Before(claimedAt))
+	assert.Equal(t, len(ld.TimeOut(ctx, test.StartedAt.Add(10*time.Minute))), 0)
+
+	// the first attempt times out while its agent is unreachable
+	test.StartedAt = time.Now().Add(-time.Hour)
+	assert.Equal(t, len(ld.TimeOut(ctx, time.Now())), 1)
+	cancelled, err := ld.Cancelled(ctx, test.ID, 1)
+	assert.NilError(t, err)
+	assert.Assert(t, cancelled)
+
+	retry := ld.GetPipeline(ctx, "")
+	assert.Equal(t, retry.Attempt, 2)
+
+	// late reports of the first attempt don't finish the second one
+	assert.ErrorIs(t, ld.PipelineStarted(ctx, test.ID, 1), ErrStaleAttempt)
+	assert.ErrorIs(t, ld.PipelineDone(ctx, test.ID, 1, PipelineFailed, ""), ErrStaleAttempt)
+	cancelled, err = ld.Cancelled(ctx, test.ID, 2)
+	assert.NilError(t, err)
+	assert.Assert(t, !cancelled)
+
+	assert.NilError(t, ld.PipelineDone(ctx, test.ID, 2, PipelineSucceeded, ""))
+	assert.Equal(t, retry.Status, PipelineSucceeded)
+
+	attempts, err := ld.Attempts(ctx, test.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, len(attempts), 2)
+	assert.Equal(t, attempts[0].Status, PipelineTimedOut)
+
+	_, err = ld.Cancelled(ctx, 42, 1)
+	assert.Error(t, err, "pipeline not found")
+}
+
+func TestLocalDispatcherConcurrency(t *testing.T) {
+	ctx := context.Background()
+	ld := NewLocalDispatcher()
+
+	deploy := func(cancelInProgress bool) []*Pipeline {
+		return []*Pipeline{
+			{Name: "deploy", Exec: []string{"deploy"}, Concurrency: &ConcurrencyPolicy{Group: "production", CancelInProgress: cancelInProgress}},
+			{Name: "smoke", Exec: []string{"smoke"}, PipelineDeps: []string{"deploy"}},
+		}
+	}
+
+	// deploys of the same group run one at a time
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "first"}, deploy(false)))
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "second"}, deploy(false)))
+	first := ld.GetPipeline(ctx, "")
+	assert.Equal(t, first.GitInfo.SHA, "first")
+	assert.Assert(t, ld.GetPipeline(ctx, "") == nil)
+
+	// a run that cancels in progress drops the queued deploy of the second
+	// run and cancels the running one of the first
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "third"}, deploy(true)))
+	cancelled, err := ld.Cancelled(ctx, first.ID, first.Attempt)
+	assert.NilError(t, err)
+	assert.Assert(t, cancelled)
+	assert.Assert(t, ld.GetPipeline(ctx, "") == nil)
+
+	// agents that don't know about cancellations still report the status
+	// of the call
+	assert.NilError(t, ld.PipelineDone(ctx, first.ID, first.Attempt, PipelineFailed, ""))
+	assert.Equal(t, first.Status, PipelineCancelled)
+
+	third := ld.GetPipeline(ctx, "")
+	assert.Equal(t, third.Name, "deploy")
+	assert.Equal(t, third.GitInfo.SHA, "third")
+	assert.Assert(t, ld.GetPipeline(ctx, "") == nil)
+
+	statuses := map[string]PipelineStatus{}
+	for _, p := range ld.done {
+		statuses[p.Name+"@"+p.GitInfo.SHA] = p.Status
+	}
+	assert.DeepEqual(t, statuses, map[string]PipelineStatus{
+		"deploy@first":  PipelineCancelled,
+		"smoke@first":   PipelineSkipped,
+		"deploy@second": PipelineCancelled,
+		"smoke@second":  PipelineSkipped,
+	})
+
+	// queued deploys of a group are claimed in the order of their runs, even
+	// when the retry of an older one is queued after them
+	ld = NewLocalDispatcher()
+	retried := []*Pipeline{{Name: "deploy", Exec: []string{"deploy"}, Retry: &RetryPolicy{Retries: 1},
+		Concurrency: &ConcurrencyPolicy{Group: "production"}}}
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "first"}, retried))
+	first = ld.GetPipeline(ctx, "")
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "second"}, retried))
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "third"}, retried))
+	assert.NilError(t, ld.PipelineDone(ctx, first.ID, first.Attempt, PipelineFailed, ""))
+
+	for _, sha := range []string{"first", "second", "third"} {
+		deploy := ld.GetPipeline(ctx, "")
+		assert.Equal(t, deploy.GitInfo.SHA, sha)
+		assert.Assert(t, ld.GetPipeline(ctx, "") == nil)
+		assert.NilError(t, ld.PipelineDone(ctx, deploy.ID, deploy.Attempt, PipelineSucceeded, ""))
+	}
+
+	// groups with the same name in different repositories don't collide
+	ld = NewLocalDispatcher()
+	production := func(repository string) []*Pipeline {
+		return []*Pipeline{{Name: "deploy", Repository: repository, Exec: []string{"deploy"},
+			Concurrency: &ConcurrencyPolicy{Group: "production", CancelInProgress: true}}}
+	}
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "first"}, production("franela/api")))
+	assert.NilError(t, ld.Dispatch(ctx, GitInfo{SHA: "second"}, production("franela/web")))
+
+	api := ld.GetPipeline(ctx, "")
+	assert.Equal(t, api.Repository, "franela/api")
+	assert.Equal(t, api.Concurrency, "franela/api/production")
+	cancelled, err = ld.Cancelled(ctx, api.ID, api.Attempt)
+	assert.NilError(t, err)
+	assert.Assert(t, !cancelled)
+
+	web := ld.GetPipeline(ctx, "")
+	assert.Assert(t, web != nil)
+	assert.Equal(t, web.Repository, "franela/web")
+}
@@ -72,6 +72,65 @@ func hasFunction(ctx context.Context, mod *dagger.Module, functions ...string) (
 	return "", ErrNoFunctionsMatched
 }
 
+// functionArgs returns the name of the arguments of the function `fn` of the
+// module's main object.
+func functionArgs(ctx context.Context, mod *dagger.Module, fn string) ([]string, error) {
+	modName, err := mod.Name(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not get module name: %s", err)
+	}
+	modName = strcase.ToLowerCamel(modName)
+
+	objects, err := mod.Objects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list module objects: %s", err)
+	}
+
+	for _, obj := range objects {
+		object := obj.AsObject()
+		if object == nil {
+			continue
+		}
+
+		objName, err := object.Name(ctx)
+		if err != nil || strcase.ToLowerCamel(objName) != modName {
+			continue
+		}
+
+		functions, err := object.Functions(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list functions from object %s: %s", objName, err)
+		}
+
+		for _, function := range functions {
+			fnName, err := function.Name(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("could not get function name for object %s: %s", objName, err)
+			}
+			if fnName != fn {
+				continue
+			}
+
+			args, err := function.Args(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("could not get args for function %s: %s", fnName, err)
+			}
+
+			names := []string{}
+			for _, arg := range args {
+				argName, err := arg.Name(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("could not argument for function %s: %s", fnName, err)
+				}
+				names = append(names, argName)
+			}
+			return names, nil
+		}
+	}
+
+	return nil, ErrNoFunctionsMatched
+}
+
 func matchFunctions(ctx context.Context, vendor, eventType, filter string, changes []string, mod *dagger.Module) ([]Function, error) {
 	modName, err := mod.Name(ctx)
 	if err != nil {
@@ -46,7 +46,7 @@ func TestMatchFunctions(t *testing.T) {
 	}{
 		{
 			name:              "filter gets matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-filter").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-filter").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -54,7 +54,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "event gets matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-event").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-event").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -62,7 +62,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "vendor gets matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-vendor").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-vendor").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -70,7 +70,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "dispatch gets matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -78,7 +78,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:   "event with prefix gets matched",
-			mod:    client.Host().Directory(moduleBasePath() + "/dispatch-suffix").AsModule().Initialize(),
+			mod:    client.Host().Directory(moduleBasePath() + "/dispatch-suffix").AsModule(),
 			vendor: "github",
 			event:  "pull_request",
 			filter: "opened",
@@ -89,7 +89,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "no functions match",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-none").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-none").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -97,7 +97,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "match by files changed",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-changed-files").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-changed-files").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -106,7 +106,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "no functions because vendor is not matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-vendor").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-vendor").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -114,7 +114,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "no functions because filter is not matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-filter").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-filter").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -122,7 +122,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "no functions because event is not matched",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-event").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-event").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "opened",
@@ -130,7 +130,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "vendor matches via field defaultValue",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-vendor").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-vendor").AsModule(),
 			vendor:            "gitlab",
 			event:             "push",
 			filter:            "main",
@@ -138,7 +138,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "filter matches via field defaultValue",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-filter").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-filter").AsModule(),
 			vendor:            "github",
 			event:             "pull_request",
 			filter:            "synchronize",
@@ -146,7 +146,7 @@ func TestMatchFunctions(t *testing.T) {
 		},
 		{
 			name:              "event matches via field defaultValue",
-			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-event").AsModule().Initialize(),
+			mod:               client.Host().Directory(moduleBasePath() + "/dispatch-match-event").AsModule(),
 			vendor:            "github",
 			event:             "push",
 			filter:            "main",
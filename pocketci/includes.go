@@ -0,0 +1,188 @@
+package pocketci
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// SpecIncludes reads the specs included by other specs from the mirrors of
+// their repositories, so they are fetched with the same credentials. Includes
+// are pinned to a commit or a tag. Tags can be moved, so they are resolved on
+// every include while the specs are cached by commit. Concurrent includes of
+// the same spec share a single fetch.
+type SpecIncludes struct {
+	mirrors *Mirrors
+
+	mu    sync.Mutex
+	cache map[string]*Spec
+	calls map[string]*includeCall
+}
+
+// includeCall is a fetch of an included spec in progress. `done` is closed
+// once `spec` and `err` are set.
+type includeCall struct {
+	done chan struct{}
+	spec *Spec
+	err  error
+}
+
+func NewSpecIncludes(mirrors *Mirrors) *SpecIncludes {
+	return &SpecIncludes{mirrors: mirrors, cache: map[string]*Spec{}, calls: map[string]*includeCall{}}
+}
+
+var commitSHA = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolve merges `spec` with the spec it includes, if any, and completes it.
+// The included spec provides the defaults: its paths are added to the ones of
+// `spec`, its secrets are used unless `spec` defines a secret with the same
+// name, its module is used unless `spec` sets one and its checkout options are
+// used for the ones `spec` doesn't set.
+func (i *SpecIncludes) resolve(ctx context.Context, spec *Spec) error {
+	if spec.Include == nil {
+		return nil
+	}
+	if i == nil {
+		return fmt.Errorf("invalid %s: includes are not supported", spec.file)
+	}
+
+	included, err := i.get(ctx, *spec.Include)
+	if err != nil {
+		return fmt.Errorf("could not include spec of %s in %s: %w", spec.Include.Repository, spec.file, err)
+	}
+
+	if spec.ModulePath == "" {
+		spec.ModulePath = included.ModulePath
+	}
+
+	paths := slices.Clone(included.Paths)
+	for _, p := range spec.Paths {
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	spec.Paths = paths
+
+	secrets := []SecretSpec{}
+	for _, secret := range included.Secrets {
+		if !slices.ContainsFunc(spec.Secrets, func(s SecretSpec) bool { return s.Name == secret.Name }) {
+			secrets = append(secrets, secret)
+		}
+	}
+	spec.Secrets = append(secrets, spec.Secrets...)
+
+	spec.Checkout.Submodules = cmp.Or(spec.Checkout.Submodules, included.Checkout.Submodules)
+	spec.Checkout.LFS = cmp.Or(spec.Checkout.LFS, included.Checkout.LFS)
+	spec.Checkout.MergeRef = cmp.Or(spec.Checkout.MergeRef, included.Checkout.MergeRef)
+	spec.Checkout.Sparse = cmp.Or(spec.Checkout.Sparse, included.Checkout.Sparse)
+
+	spec.Include = nil
+	return spec.complete()
+}
+
+// get returns the spec of `include`, fetching it unless it is cached. The lock
+// is only held to access the cache and the fetches in progress, so includes of
+// other specs don't wait for the fetch.
+func (i *SpecIncludes) get(ctx context.Context, include SpecInclude) (*Spec, error) {
+	repoURL := include.Repository
+	if !strings.Contains(repoURL, "://") {
+		repoURL = GithubURL(repoURL)
+	}
+	file := include.File
+	if file == "" {
+		file = SpecFile
+	}
+	key := repoURL + "@" + include.Ref + ":" + file
+
+	i.mu.Lock()
+	if spec, ok := i.cache[key]; ok {
+		i.mu.Unlock()
+		return spec, nil
+	}
+	call, inProgress := i.calls[key]
+	if !inProgress {
+		call = &includeCall{done: make(chan struct{})}
+		i.calls[key] = call
+	}
+	i.mu.Unlock()
+
+	if inProgress {
+		select {
+		case <-call.done:
+			return call.spec, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call.spec, call.err = i.fetch(ctx, repoURL, include.Ref, file)
+
+	i.mu.Lock()
+	delete(i.calls, key)
+	i.mu.Unlock()
+	close(call.done)
+
+	return call.spec, call.err
+}
+
+// fetch reads `file` at `ref` from the mirror of `repoURL` and caches it by
+// commit.
+func (i *SpecIncludes) fetch(ctx context.Context, repoURL, ref, file string) (*Spec, error) {
+	mirror, err := i.mirrors.Fetch(ctx, repoURL, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sha := ref
+	if commitSHA.MatchString(sha) {
+		err = mirror.FetchCommit(ctx, sha)
+	} else {
+		if !strings.HasPrefix(ref, "refs/") {
+			ref = "refs/tags/" + ref
+		}
+		sha, err = mirror.FetchRef(ctx, ref)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := repoURL + "@" + sha + ":" + file
+	i.mu.Lock()
+	spec, ok := i.cache[key]
+	i.mu.Unlock()
+	if ok {
+		return spec, nil
+	}
+
+	contents, err := mirror.ReadFile(ctx, sha, file)
+	if err != nil {
+		return nil, err
+	}
+	spec, err = parseSpec(file, contents)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case spec.Include != nil:
+		return nil, fmt.Errorf("invalid %s: included specs can't include other specs", file)
+	case len(spec.Specs) > 0:
+		return nil, fmt.Errorf("invalid %s: included specs can't list other specs", file)
+	}
+
+	// sops files are read from the repository of the included spec
+	for n, secret := range spec.Secrets {
+		if secret.FromSops != "" {
+			spec.Secrets[n].source = &secretSource{mirror: mirror, sha: sha}
+		}
+	}
+
+	i.mu.Lock()
+	i.cache[key] = spec
+	i.mu.Unlock()
+	return spec, nil
+}
@@ -0,0 +1,214 @@
+package pocketci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/v61/github"
+	"gotest.tools/v3/assert"
+)
+
+func TestSpecIncludes(t *testing.T) {
+	ctx := context.Background()
+	templates := newTestRepo(t)
+	first := templates.commit(map[string]string{
+		"go-service.yaml": `
+module-path: ci
+paths: ["**/*.go", "go.*"]
+secrets:
+  - name: ghToken
+    from-env: GITHUB_TOKEN
+  - name: registryPassword
+    from-env: REGISTRY_PASSWORD
+checkout:
+  submodules: true
+`,
+	})
+	templates.git("tag", "v1.0.0")
+	templates.commit(map[string]string{"go-service.yaml": "module-path: build"})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	includes := NewSpecIncludes(mirrors)
+
+	cases := []struct {
+		name     string
+		contents string
+		expected *Spec
+		err      string
+	}{
+		{
+			name: "tag with local overrides",
+			contents: `
+include:
+  repository: ` + templates.url() + `
+  ref: v1.0.0
+  file: go-service.yaml
+paths: ["Dockerfile"]
+secrets:
+  - name: registryPassword
+    from-env: OTHER_REGISTRY_PASSWORD
+`,
+			expected: &Spec{
+				Version:    1,
+				ModulePath: "ci",
+				Paths:      []string{"**/*.go", "go.*", "Dockerfile"},
+				Secrets: []SecretSpec{
+					{Name: "ghToken", FromEnv: "GITHUB_TOKEN"},
+					{Name: "registryPassword", FromEnv: "OTHER_REGISTRY_PASSWORD"},
+				},
+				Checkout: SpecCheckout{Submodules: github.Bool(true)},
+				file:     SpecFile,
+			},
+		},
+		{
+			name: "commit with local module",
+			contents: `
+include:
+  repository: ` + templates.url() + `
+  ref: ` + first + `
+  file: go-service.yaml
+module-path: tools/ci
+`,
+			expected: &Spec{
+				Version:    1,
+				ModulePath: "tools/ci",
+				Paths:      []string{"**/*.go", "go.*"},
+				Secrets: []SecretSpec{
+					{Name: "ghToken", FromEnv: "GITHUB_TOKEN"},
+					{Name: "registryPassword", FromEnv: "REGISTRY_PASSWORD"},
+				},
+				Checkout: SpecCheckout{Submodules: github.Bool(true)},
+				file:     SpecFile,
+			},
+		},
+		{
+			name: "local checkout options",
+			contents: `
+include:
+  repository: ` + templates.url() + `
+  ref: v1.0.0
+  file: go-service.yaml
+checkout:
+  submodules: false
+  lfs: true
+`,
+			expected: &Spec{
+				Version:    1,
+				ModulePath: "ci",
+				Paths:      []string{"**/*.go", "go.*"},
+				Secrets: []SecretSpec{
+					{Name: "ghToken", FromEnv: "GITHUB_TOKEN"},
+					{Name: "registryPassword", FromEnv: "REGISTRY_PASSWORD"},
+				},
+				Checkout: SpecCheckout{Submodules: github.Bool(false), LFS: github.Bool(true)},
+				file:     SpecFile,
+			},
+		},
+		{
+			name:     "missing file",
+			contents: "include: {repository: " + templates.url() + ", ref: v1.0.0}",
+			err:      "pocketci.yaml: file does not exist",
+		},
+		{
+			name:     "missing ref",
+			contents: "include: {repository: franela/ci-templates}",
+			err:      "invalid pocketci.yaml: include needs a repository and a ref",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := parseSpec(SpecFile, []byte(tc.contents))
+			if err == nil {
+				err = includes.resolve(ctx, spec)
+			}
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, spec, tc.expected, cmpSpec)
+		})
+	}
+
+	// includes are cached by commit, tags are resolved again
+	assert.Equal(t, len(includes.cache), 1)
+	templates.git("tag", "--force", "v1.0.0")
+
+	spec, err := parseSpec(SpecFile, []byte("include: {repository: "+templates.url()+", ref: v1.0.0, file: go-service.yaml}"))
+	assert.NilError(t, err)
+	assert.NilError(t, includes.resolve(ctx, spec))
+	assert.Equal(t, spec.ModulePath, "build")
+	assert.Equal(t, len(includes.cache), 2)
+}
+
+func TestSpecIncludesConcurrent(t *testing.T) {
+	ctx := context.Background()
+	templates := newTestRepo(t)
+	sha := templates.commit(map[string]string{"pocketci.yaml": "module-path: ci"})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	includes := NewSpecIncludes(mirrors)
+
+	// concurrent includes of the same spec share the fetch and the result
+	specs := make([]*Spec, 5)
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for n := range specs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			specs[n], errs[n] = includes.get(ctx, SpecInclude{Repository: templates.url(), Ref: sha})
+		}()
+	}
+	wg.Wait()
+
+	for n := range specs {
+		assert.NilError(t, errs[n])
+		assert.Equal(t, specs[n], specs[0])
+	}
+	assert.Equal(t, specs[0].ModulePath, "ci")
+	assert.Equal(t, len(includes.cache), 1)
+	assert.Equal(t, len(includes.calls), 0)
+}
+
+func TestSpecIncludesSops(t *testing.T) {
+	ctx := context.Background()
+	templates := newTestRepo(t)
+	templates.commit(map[string]string{
+		"pocketci.yaml":    "secrets: [{name: dbPassword, from-sops: secrets.enc.json, key: db.password}]",
+		"secrets.enc.json": `{"db": {"password": "template"}}`,
+	})
+	templates.git("tag", "v1.0.0")
+
+	repo := newTestRepo(t)
+	sha := repo.commit(map[string]string{
+		"apps/api/pocketci.yaml": "include: {repository: " + templates.url() + ", ref: v1.0.0}",
+		"secrets.enc.json":       `{"db": {"password": "local"}}`,
+	})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	mirror, err := mirrors.Fetch(ctx, repo.url(), sha, "refs/heads/main")
+	assert.NilError(t, err)
+
+	spec, err := readSpec(ctx, mirror, sha, "apps/api/pocketci.yaml", NewSpecIncludes(mirrors))
+	assert.NilError(t, err)
+	assert.NilError(t, spec.nest())
+
+	// stands in for sops, the file is not encrypted
+	sops := filepath.Join(t.TempDir(), "sops")
+	assert.NilError(t, os.WriteFile(sops, []byte("#!/bin/sh\ncat \"$4\"\n"), 0o755))
+	backends := DefaultSecretBackends()
+	backends.Sops = &SopsSecrets{Command: []string{sops}}
+
+	// the sops file is read from the repository of the included spec
+	secrets, err := spec.resolveSecrets(ctx, backends, &GithubEvent{mirror: mirror, SHA: sha})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, secrets, map[string]string{"dbPassword": "template"})
+}
@@ -0,0 +1,159 @@
+package pocketci
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Matrix fans a pipeline out into one job for each combination of the values
+// of its axes. The calls of each job are rendered with the values of its
+// combination, e.g. `test --go-version {{.go}}` (see `renderPipelines`).
+type Matrix struct {
+	Axes []MatrixAxis `json:"axes"`
+	// Include are combinations added to the ones of the axes. They can set
+	// keys that are not axes.
+	Include []map[string]string `json:"include"`
+	// Exclude removes the combinations of the axes that have every value of
+	// any of its entries.
+	Exclude []map[string]string `json:"exclude"`
+}
+
+type MatrixAxis struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// combinations returns every combination of the matrix in a stable order: the
+// ones of the axes, in the order of their values, followed by the included
+// ones.
+func (m *Matrix) combinations() ([]map[string]string, error) {
+	seen := map[string]bool{}
+	for _, axis := range m.Axes {
+		switch {
+		case axis.Name == "":
+			return nil, errors.New("matrix axis has no name")
+		case seen[axis.Name]:
+			return nil, fmt.Errorf("matrix axis %s is defined more than once", axis.Name)
+		case len(axis.Values) == 0:
+			return nil, fmt.Errorf("matrix axis %s has no values", axis.Name)
+		}
+		seen[axis.Name] = true
+	}
+
+	combinations := []map[string]string{}
+	if len(m.Axes) > 0 {
+		combinations = append(combinations, map[string]string{})
+	}
+	for _, axis := range m.Axes {
+		next := []map[string]string{}
+		for _, c := range combinations {
+			for _, value := range axis.Values {
+				combination := maps.Clone(c)
+				combination[axis.Name] = value
+				next = append(next, combination)
+			}
+		}
+		combinations = next
+	}
+
+	combinations = slices.DeleteFunc(combinations, func(c map[string]string) bool {
+		return slices.ContainsFunc(m.Exclude, func(exclude map[string]string) bool {
+			for key, value := range exclude {
+				if c[key] != value {
+					return false
+				}
+			}
+			return true
+		})
+	})
+
+	for _, include := range m.Include {
+		if !slices.ContainsFunc(combinations, func(c map[string]string) bool { return maps.Equal(c, include) }) {
+			combinations = append(combinations, include)
+		}
+	}
+
+	if len(combinations) == 0 {
+		return nil, errors.New("matrix has no combinations")
+	}
+	return combinations, nil
+}
+
+// jobName returns the stable name of the job of the pipeline `name` for
+// `combination`, e.g. `test (go=1.22, os=linux)`. Axes come first in their
+// order, followed by the keys of included combinations in lexical order.
+func (m *Matrix) jobName(name string, combination map[string]string) string {
+	keys := []string{}
+	for _, axis := range m.Axes {
+		if _, ok := combination[axis.Name]; ok {
+			keys = append(keys, axis.Name)
+		}
+	}
+	for _, key := range slices.Sorted(maps.Keys(combination)) {
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+
+	values := []string{}
+	for _, key := range keys {
+		values = append(values, key+"="+combination[key])
+	}
+	return fmt.Sprintf("%s (%s)", name, strings.Join(values, ", "))
+}
+
+// expandMatrix returns the jobs of a matrix pipeline, one for each
+// combination. Pipelines without a matrix are returned as they are.
+func expandMatrix(p *Pipeline) ([]*Pipeline, error) {
+	if p.Matrix == nil {
+		return []*Pipeline{p}, nil
+	}
+
+	combinations, err := p.Matrix.combinations()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []*Pipeline{}
+	for _, combination := range combinations {
+		job := *p
+		job.Name = p.Matrix.jobName(p.Name, combination)
+		job.Matrix = nil
+		job.MatrixValues = combination
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// expandMatrices replaces the matrix pipelines by their jobs. Pipelines that
+// run after a matrix pipeline wait for every one of its jobs.
+func expandMatrices(pipelines []*Pipeline) ([]*Pipeline, error) {
+	expanded := []*Pipeline{}
+	jobNames := map[string][]string{}
+	for _, p := range pipelines {
+		jobs, err := expandMatrix(p)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		for _, job := range jobs {
+			jobNames[p.Name] = append(jobNames[p.Name], job.Name)
+		}
+		expanded = append(expanded, jobs...)
+	}
+
+	for _, p := range expanded {
+		deps := []string{}
+		for _, dep := range p.PipelineDeps {
+			if names, ok := jobNames[dep]; ok {
+				deps = append(deps, names...)
+				continue
+			}
+			deps = append(deps, dep)
+		}
+		p.PipelineDeps = deps
+	}
+	return expanded, nil
+}
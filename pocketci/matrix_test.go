@@ -0,0 +1,111 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	axes := []MatrixAxis{
+		{Name: "go", Values: []string{"1.22", "1.23"}},
+		{Name: "os", Values: []string{"linux", "windows"}},
+	}
+
+	cases := []struct {
+		name     string
+		matrix   *Matrix
+		exec     string
+		expected map[string]string
+		err      string
+	}{
+		{
+			name: "no matrix",
+			exec: "test",
+			expected: map[string]string{
+				"test": "test",
+			},
+		},
+		{
+			name:   "axes",
+			matrix: &Matrix{Axes: axes},
+			exec:   "test --go-version {{.go}} --os {{.os}}",
+			expected: map[string]string{
+				"test (go=1.22, os=linux)":   "test --go-version '1.22' --os 'linux'",
+				"test (go=1.22, os=windows)": "test --go-version '1.22' --os 'windows'",
+				"test (go=1.23, os=linux)":   "test --go-version '1.23' --os 'linux'",
+				"test (go=1.23, os=windows)": "test --go-version '1.23' --os 'windows'",
+			},
+		},
+		{
+			name: "include and exclude",
+			matrix: &Matrix{
+				Axes:    axes,
+				Exclude: []map[string]string{{"os": "windows"}},
+				Include: []map[string]string{{"go": "1.24", "os": "linux", "experimental": "true"}, {"go": "1.22", "os": "linux"}},
+			},
+			exec: "test --go-version {{.go}} --os {{.os}}",
+			expected: map[string]string{
+				"test (go=1.22, os=linux)":                    "test --go-version '1.22' --os 'linux'",
+				"test (go=1.23, os=linux)":                    "test --go-version '1.23' --os 'linux'",
+				"test (go=1.24, os=linux, experimental=true)": "test --go-version '1.24' --os 'linux'",
+			},
+		},
+		{
+			name:   "unknown key",
+			matrix: &Matrix{Axes: axes},
+			exec:   "test --arch {{.arch}}",
+			err:    `pipeline test (go=1.22, os=linux): template: call:1:14: executing "call" at <.arch>: map has no entry for key "arch"`,
+		},
+		{
+			name:   "axis without values",
+			matrix: &Matrix{Axes: []MatrixAxis{{Name: "go"}}},
+			exec:   "test",
+			err:    "matrix axis go has no values",
+		},
+		{
+			name:   "everything excluded",
+			matrix: &Matrix{Axes: axes[:1], Exclude: []map[string]string{{}}},
+			exec:   "test",
+			err:    "matrix has no combinations",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			jobs, err := expandMatrix(&Pipeline{Name: "test", Matrix: tc.matrix, Exec: []string{tc.exec}})
+			if err == nil {
+				err = renderPipelines(&GithubEvent{}, jobs)
+			}
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+
+			calls := map[string]string{}
+			for _, job := range jobs {
+				assert.Assert(t, job.Matrix == nil)
+				calls[job.Name] = job.Exec[0]
+			}
+			assert.DeepEqual(t, calls, tc.expected)
+		})
+	}
+}
+
+func TestExpandMatrices(t *testing.T) {
+	pipelines, err := expandMatrices([]*Pipeline{
+		{Name: "test", Exec: []string{"test --go-version {{.go}}"}, Matrix: &Matrix{Axes: []MatrixAxis{{Name: "go", Values: []string{"1.22", "1.23"}}}}},
+		{Name: "lint", Exec: []string{"lint"}},
+		{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"test", "lint"}},
+	})
+	assert.NilError(t, err)
+
+	names := []string{}
+	for _, p := range pipelines {
+		names = append(names, p.Name)
+	}
+	assert.DeepEqual(t, names, []string{"test (go=1.22)", "test (go=1.23)", "lint", "publish"})
+	assert.DeepEqual(t, pipelines[1].MatrixValues, map[string]string{"go": "1.23"})
+	assert.DeepEqual(t, pipelines[3].PipelineDeps, []string{"test (go=1.22)", "test (go=1.23)", "lint"})
+}
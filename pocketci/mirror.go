@@ -0,0 +1,628 @@
+package pocketci
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"dagger.io/dagger"
+)
+
+// Mirrors is a persistent store of bare repositories kept on the host. Each
+// event incrementally fetches into the mirror of its repository and checkouts
+// are produced out of it, which is much cheaper than cloning on every webhook.
+type Mirrors struct {
+	// Depth limits the history fetched into new mirrors. Shallow mirrors are
+	// deepened on demand when more history is needed. Zero fetches the whole
+	// history.
+	Depth int
+	// Blobless makes mirrors partial clones that only fetch the contents of
+	// files when they are checked out or read.
+	Blobless bool
+
+	root        string
+	credentials CredentialProvider
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+const (
+	// DefaultMirrorDepth is the history depth used for new mirrors.
+	DefaultMirrorDepth = 50
+
+	// mergeBaseDeepen is the number of commits a shallow mirror is deepened
+	// by on every attempt to find a merge base.
+	mergeBaseDeepen = 50
+	// mergeBaseAttempts is the number of times a shallow mirror is deepened
+	// before fetching its whole history.
+	mergeBaseAttempts = 5
+)
+
+// DefaultMirrorsPath returns the directory used to store mirrors when none is
+// configured.
+func DefaultMirrorsPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pocketci", "mirrors")
+}
+
+func NewMirrors(root string, credentials CredentialProvider) (*Mirrors, error) {
+	if err := os.MkdirAll(filepath.Join(root, "worktrees"), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create mirrors directory: %w", err)
+	}
+
+	return &Mirrors{
+		root:        root,
+		credentials: credentials,
+		locks:       map[string]*sync.Mutex{},
+	}, nil
+}
+
+// CheckoutOptions configure what is checked out along with the repository.
+type CheckoutOptions struct {
+	// Submodules are initialized recursively using the same credentials as
+	// the repository.
+	Submodules bool `json:"submodules" yaml:"submodules"`
+	// LFS objects are pulled.
+	LFS bool `json:"lfs" yaml:"lfs"`
+	// MergeRef makes pull request pipelines test the result of merging the
+	// pull request instead of its head.
+	MergeRef bool `json:"merge_ref" yaml:"merge-ref"`
+	// Sparse checks out only the paths pipelines need instead of the whole
+	// repository, see `checkoutPaths`.
+	Sparse bool `json:"sparse" yaml:"sparse"`
+
+	// Paths limits the checkout to the given paths. They are set for each
+	// pipeline, the whole repository is checked out when empty.
+	Paths []string `json:"-" yaml:"-"`
+}
+
+// gitlinkMode is the mode git uses for submodule entries.
+const gitlinkMode = "160000"
+
+// Mirror is a bare repository inside the store.
+type Mirror struct {
+	Path string
+	URL  string
+
+	mirrors   *Mirrors
+	worktrees string
+	env       []string
+	fetch     []string
+	refspecs  []string
+	lock      *sync.Mutex
+}
+
+// Fetch makes sure the mirror of `repoURL` has every one of `refs` and the
+// commit `sha`, creating the mirror if it does not exist yet. Only what is
+// missing from the mirror is transferred.
+func (m *Mirrors) Fetch(ctx context.Context, repoURL, sha string, refs ...string) (*Mirror, error) {
+	path, err := m.path(repoURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var env []string
+	if m.credentials != nil {
+		if env, err = m.credentials.Env(ctx, repoURL); err != nil {
+			return nil, fmt.Errorf("could not get credentials of %s: %w", repoURL, err)
+		}
+	}
+
+	mirror := &Mirror{
+		Path:      path,
+		URL:       repoURL,
+		mirrors:   m,
+		worktrees: filepath.Join(m.root, "worktrees"),
+		env:       env,
+		lock:      m.lock(path),
+	}
+	for _, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		mirror.refspecs = append(mirror.refspecs, fmt.Sprintf("+%s:%s", ref, ref))
+	}
+
+	mirror.lock.Lock()
+	defer mirror.lock.Unlock()
+
+	created := false
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		slog.Info("creating repository mirror", slog.String("repository", repoURL), slog.String("path", path))
+		if _, err := runGit(ctx, "", nil, "init", "--bare", "--quiet", path); err != nil {
+			return nil, err
+		}
+		created = true
+	}
+
+	// the origin is fetched from, lazily fetches the files of blobless
+	// mirrors and is used by git lfs and to resolve relative submodule urls
+	if _, err := mirror.git(ctx, "config", "remote.origin.url", originURL(repoURL)); err != nil {
+		return nil, err
+	}
+
+	// mirrors that have the whole history are never made shallow, and the
+	// ones deepened to find a merge base are not shortened again
+	mirror.fetch = []string{"fetch", "--quiet", "--no-tags"}
+	if m.Depth > 0 && (created || (mirror.isShallow(ctx) && !mirror.deepened(ctx))) {
+		mirror.fetch = append(mirror.fetch, "--depth", strconv.Itoa(m.Depth))
+	}
+	if m.Blobless {
+		mirror.fetch = append(mirror.fetch, "--filter=blob:none")
+	}
+
+	// worktrees of checkouts that were never removed (e.g. the process died)
+	// are left behind otherwise
+	if _, err := mirror.git(ctx, "worktree", "prune"); err != nil {
+		return nil, err
+	}
+
+	slog.Info("fetching repository mirror", slog.String("repository", repoURL), slog.String("sha", sha),
+		slog.String("refs", strings.Join(refs, ",")))
+	if len(mirror.refspecs) > 0 {
+		if _, err := mirror.git(ctx, slices.Concat(mirror.fetch, []string{"origin"}, mirror.refspecs)...); err != nil {
+			return nil, err
+		}
+	}
+
+	// the commit might not be reachable from the refs anymore (e.g. force
+	// pushes) so we fetch it directly as a last resort
+	if err := mirror.fetchCommit(ctx, sha); err != nil {
+		return nil, err
+	}
+
+	return mirror, nil
+}
+
+// path returns the location of the mirror of `repoURL` within the store.
+func (m *Mirrors) path(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository url %s: %w", repoURL, err)
+	}
+
+	name := filepath.Clean(filepath.Join("/", u.Host, strings.TrimSuffix(u.Path, ".git")))
+	if name == "/" {
+		return "", fmt.Errorf("invalid repository url %s", repoURL)
+	}
+	return filepath.Join(m.root, name+".git"), nil
+}
+
+func (m *Mirrors) lock(path string) *sync.Mutex {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.locks[path]; !ok {
+		m.locks[path] = &sync.Mutex{}
+	}
+	return m.locks[path]
+}
+
+// FetchCommit fetches the commit `sha` into the mirror unless it is already
+// present.
+func (m *Mirror) FetchCommit(ctx context.Context, sha string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.fetchCommit(ctx, sha)
+}
+
+func (m *Mirror) fetchCommit(ctx context.Context, sha string) error {
+	if sha == "" || m.HasCommit(ctx, sha) {
+		return nil
+	}
+
+	_, err := m.git(ctx, slices.Concat(m.fetch, []string{"origin", sha})...)
+	return err
+}
+
+// FetchRef fetches `ref` into the mirror and returns the commit it points to.
+func (m *Mirror) FetchRef(ctx context.Context, ref string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, err := m.git(ctx, slices.Concat(m.fetch, []string{"origin", fmt.Sprintf("+%s:%s", ref, ref)})...); err != nil {
+		return "", err
+	}
+
+	out, err := m.git(ctx, "rev-parse", ref+"^{commit}")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// ReadFile returns the contents of the file at `path` in the commit `sha`. The
+// error wraps `os.ErrNotExist` if the file does not exist.
+func (m *Mirror) ReadFile(ctx context.Context, sha, path string) ([]byte, error) {
+	object := sha + ":" + path
+	if _, err := m.git(ctx, "cat-file", "-e", object); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, os.ErrNotExist)
+	}
+
+	out, err := m.git(ctx, "cat-file", "blob", object)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// Files returns the path of every file of the tree of `sha`, in lexical order.
+func (m *Mirror) Files(ctx context.Context, sha string) ([]string, error) {
+	out, err := m.git(ctx, "ls-tree", "-r", "-z", "--name-only", sha)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// HasCommit reports whether the commit `sha` is present in the mirror.
+func (m *Mirror) HasCommit(ctx context.Context, sha string) bool {
+	_, err := m.git(ctx, "cat-file", "-e", sha+"^{commit}")
+	return err == nil
+}
+
+// MergeBase returns the best common ancestor of `sha` and `baseSha`. Shallow
+// mirrors are deepened until the merge base is found.
+func (m *Mirror) MergeBase(ctx context.Context, sha, baseSha string) (string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		out, err := m.git(ctx, "merge-base", sha, baseSha)
+		if err == nil {
+			return strings.TrimSpace(out), nil
+		}
+
+		if !m.isShallow(ctx) {
+			return "", fmt.Errorf("could not find merge base between %s and %s: %w", sha, baseSha, err)
+		}
+
+		deepen := fmt.Sprintf("--deepen=%d", mergeBaseDeepen)
+		if attempt >= mergeBaseAttempts {
+			deepen = "--unshallow"
+		}
+		slog.Info("deepening mirror to find merge base", slog.String("repository", m.URL),
+			slog.String("sha", sha), slog.String("base_sha", baseSha), slog.String("deepen", deepen))
+
+		args := []string{"fetch", "--quiet", "--no-tags", deepen}
+		if m.mirrors.Blobless {
+			args = append(args, "--filter=blob:none")
+		}
+		if _, err := m.git(ctx, slices.Concat(args, []string{"origin"}, m.refspecs)...); err != nil {
+			return "", err
+		}
+		if _, err := m.git(ctx, "config", deepenedKey, "true"); err != nil {
+			return "", err
+		}
+	}
+}
+
+// deepenedKey is set in the config of mirrors that were deepened beyond
+// `Mirrors.Depth`.
+const deepenedKey = "pocketci.deepened"
+
+func (m *Mirror) deepened(ctx context.Context) bool {
+	out, err := m.git(ctx, "config", "--get", deepenedKey)
+	return err == nil && strings.TrimSpace(out) == "true"
+}
+
+// Diff returns the files that changed in `sha`. If `baseSha` is specified the
+// comparison is made against it, if not `sha` is compared against its parent.
+// Every file is reported as added for root commits.
+func (m *Mirror) Diff(ctx context.Context, sha, baseSha string) ([]Change, error) {
+	args := []string{"diff-tree", "-z", "--no-commit-id", "--name-status", "--find-renames", "--root", "-r"}
+	if baseSha != "" {
+		args = append(args, baseSha)
+	}
+
+	out, err := m.git(ctx, append(args, sha)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseNameStatus(out)
+}
+
+// submoduleFiles returns every file of the tree of `sha` as a change with
+// `status`, for submodules that were added or removed.
+func submoduleFiles(ctx context.Context, submodule *Mirror, sha string, status ChangeStatus) ([]Change, error) {
+	paths, err := submodule.Files(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []Change{}
+	for _, path := range paths {
+		files = append(files, Change{Path: path, Status: status})
+	}
+	return files, nil
+}
+
+// SubmoduleDiff returns the files that changed within the submodules of the
+// repository in `sha`, prefixed by the path of their submodule. Just like
+// `Diff` the comparison is made against `baseSha` if specified or against the
+// parent of `sha` otherwise. Submodules are fetched into their own mirrors.
+func (m *Mirror) SubmoduleDiff(ctx context.Context, sha, baseSha string) ([]Change, error) {
+	args := []string{"diff-tree", "--no-commit-id", "--raw", "--root", "-r"}
+	if baseSha != "" {
+		args = append(args, baseSha)
+	}
+
+	out, err := m.git(ctx, append(args, sha)...)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	for _, line := range lines(out) {
+		// :<old mode> <new mode> <old sha> <new sha> <status>\t<path>
+		info, path, ok := strings.Cut(line, "\t")
+		fields := strings.Fields(strings.TrimPrefix(info, ":"))
+		if !ok || len(fields) < 4 || (fields[0] != gitlinkMode && fields[1] != gitlinkMode) {
+			continue
+		}
+		oldSha, newSha := fields[2], fields[3]
+
+		var files []Change
+		switch {
+		case fields[1] != gitlinkMode:
+			// the submodule was removed so every file it had is gone. It is
+			// only configured in the .gitmodules of the base.
+			base := baseSha
+			if base == "" {
+				base = sha + "^"
+			}
+			submodule, err := m.submodule(ctx, base, path, oldSha)
+			if err != nil {
+				return nil, err
+			}
+			if files, err = submoduleFiles(ctx, submodule, oldSha, ChangeDeleted); err != nil {
+				return nil, err
+			}
+		case fields[0] != gitlinkMode:
+			// the submodule was just added so every file is new
+			submodule, err := m.submodule(ctx, sha, path, newSha)
+			if err != nil {
+				return nil, err
+			}
+			if files, err = submoduleFiles(ctx, submodule, newSha, ChangeAdded); err != nil {
+				return nil, err
+			}
+		default:
+			submodule, err := m.submodule(ctx, sha, path, newSha)
+			if err != nil {
+				return nil, err
+			}
+			if err := submodule.FetchCommit(ctx, oldSha); err != nil {
+				return nil, err
+			}
+			if files, err = submodule.Diff(ctx, newSha, oldSha); err != nil {
+				return nil, err
+			}
+
+			nested, err := submodule.SubmoduleDiff(ctx, newSha, oldSha)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, nested...)
+		}
+
+		for _, file := range files {
+			file.Path = path + "/" + file.Path
+			if file.OldPath != "" {
+				file.OldPath = path + "/" + file.OldPath
+			}
+			changes = append(changes, file)
+		}
+	}
+
+	return changes, nil
+}
+
+// submodule returns the mirror of the submodule at `path` in the commit `sha`
+// making sure it contains the commit `submoduleSha`.
+func (m *Mirror) submodule(ctx context.Context, sha, path, submoduleSha string) (*Mirror, error) {
+	out, err := m.git(ctx, "config", "--blob", sha+":.gitmodules", "--get-regexp", `^submodule\..*\.path$`)
+	if err != nil {
+		return nil, fmt.Errorf("could not read submodules: %w", err)
+	}
+
+	for _, line := range lines(out) {
+		key, value, _ := strings.Cut(line, " ")
+		if value != path {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(key, "submodule."), ".path")
+		out, err := m.git(ctx, "config", "--blob", sha+":.gitmodules", "--get", "submodule."+name+".url")
+		if err != nil {
+			return nil, fmt.Errorf("could not get url of submodule %s: %w", name, err)
+		}
+
+		submoduleURL, err := resolveURL(m.URL, strings.TrimSpace(out))
+		if err != nil {
+			return nil, err
+		}
+		return m.mirrors.Fetch(ctx, submoduleURL, submoduleSha)
+	}
+
+	return nil, fmt.Errorf("submodule %s is not configured in .gitmodules", path)
+}
+
+// Checkout creates a worktree of the mirror at `sha`. Only `opts.Paths` are
+// checked out when specified. The returned function removes the worktree and
+// must be called once it is no longer needed.
+func (m *Mirror) Checkout(ctx context.Context, sha string, opts CheckoutOptions) (string, func(), error) {
+	dir, err := os.MkdirTemp(m.worktrees, "checkout-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	// worktrees are added and removed while holding the lock of the mirror
+	// so they don't race with fetches updating its refs
+	remove := func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+
+		if _, err := m.git(context.Background(), "worktree", "remove", "--force", dir); err != nil {
+			slog.Error("could not remove worktree", slog.String("path", dir), slog.String("error", err.Error()))
+		}
+		os.RemoveAll(dir)
+	}
+
+	add := []string{"worktree", "add", "--quiet", "--detach", dir, sha}
+	if len(opts.Paths) > 0 {
+		// the sparse checkout is configured before checking out any file so
+		// blobless mirrors only fetch the contents of the selected paths
+		add = []string{"worktree", "add", "--quiet", "--no-checkout", "--detach", dir, sha}
+	}
+	m.lock.Lock()
+	_, err = m.git(ctx, add...)
+	m.lock.Unlock()
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	if len(opts.Paths) > 0 {
+		if _, err := runGit(ctx, dir, m.env, append([]string{"sparse-checkout", "set", "--no-cone"}, sparsePatterns(opts.Paths)...)...); err != nil {
+			remove()
+			return "", nil, err
+		}
+		if _, err := runGit(ctx, dir, m.env, "checkout", "--quiet", "--detach", sha); err != nil {
+			remove()
+			return "", nil, err
+		}
+	}
+
+	if opts.Submodules {
+		if _, err := runGit(ctx, dir, m.env, "submodule", "update", "--init", "--recursive"); err != nil {
+			remove()
+			return "", nil, err
+		}
+	}
+
+	if opts.LFS {
+		if _, err := runGit(ctx, dir, m.env, "lfs", "pull"); err != nil {
+			remove()
+			return "", nil, err
+		}
+	}
+
+	return dir, remove, nil
+}
+
+// Snapshot loads the contents of the repository at `sha` into a
+// `dagger.Directory`. The `.git` directory is not part of the snapshot.
+func (m *Mirror) Snapshot(ctx context.Context, dag *dagger.Client, sha string, opts CheckoutOptions) (*dagger.Directory, error) {
+	dir, remove, err := m.Checkout(ctx, sha, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer remove()
+
+	// the directory needs to be loaded before the worktree is removed
+	return dag.Host().Directory(dir, dagger.HostDirectoryOpts{Exclude: []string{".git"}}).Sync(ctx)
+}
+
+// sparsePatterns converts paths relative to the root of the repository, which
+// can be globs, into patterns of a non-cone sparse checkout. The root path
+// selects the files at the top of the repository.
+func sparsePatterns(paths []string) []string {
+	patterns := []string{}
+	root := false
+	for _, p := range paths {
+		p = path.Clean("/" + p)
+		if p == "/" {
+			root = true
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+
+	// later patterns take precedence so directories excluded by the root
+	// patterns can still be selected
+	if root {
+		patterns = append([]string{"/*", "!/*/"}, patterns...)
+	}
+	return patterns
+}
+
+func (m *Mirror) isShallow(ctx context.Context) bool {
+	out, err := m.git(ctx, "rev-parse", "--is-shallow-repository")
+	return err == nil && strings.TrimSpace(out) == "true"
+}
+
+func (m *Mirror) git(ctx context.Context, args ...string) (string, error) {
+	return runGit(ctx, m.Path, m.env, args...)
+}
+
+// originURL returns the url mirrors of `repoURL` fetch from. Https urls end in
+// `.git` so the rules that rewrite them (see `SSHKey`) only match the
+// repository and not every repository whose name starts with its name.
+func originURL(repoURL string) string {
+	if !strings.HasPrefix(repoURL, "https://") {
+		return repoURL
+	}
+	return strings.TrimSuffix(repoURL, ".git") + ".git"
+}
+
+// resolveURL resolves the url of a submodule, which can be relative to the url
+// of its parent repository.
+func resolveURL(parentURL, submoduleURL string) (string, error) {
+	if !strings.HasPrefix(submoduleURL, "./") && !strings.HasPrefix(submoduleURL, "../") {
+		return submoduleURL, nil
+	}
+
+	u, err := url.Parse(parentURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository url %s: %w", parentURL, err)
+	}
+	u.Path = path.Join(u.Path, submoduleURL)
+	return u.String(), nil
+}
+
+func runGit(ctx context.Context, dir string, env []string, args ...string) (string, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// LFS objects are only pulled when requested through `CheckoutOptions`
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_LFS_SKIP_SMUDGE=1"), env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %s: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
+
+func lines(out string) []string {
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return []string{}
+	}
+	return strings.Split(out, "\n")
+}
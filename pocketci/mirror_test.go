@@ -0,0 +1,278 @@
+package pocketci
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// testRepo is a local repository used as the upstream of mirrors.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Setenv("GIT_AUTHOR_NAME", "pocketci")
+	t.Setenv("GIT_AUTHOR_EMAIL", "pocketci@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "pocketci")
+	t.Setenv("GIT_COMMITTER_EMAIL", "pocketci@example.com")
+
+	repo := &testRepo{t: t, dir: t.TempDir()}
+	repo.git("init", "--quiet", "--initial-branch", "main")
+	return repo
+}
+
+func (r *testRepo) url() string {
+	return "file://" + r.dir
+}
+
+func (r *testRepo) git(args ...string) string {
+	out, err := runGit(context.Background(), r.dir, nil, args...)
+	assert.NilError(r.t, err)
+	return strings.TrimSpace(out)
+}
+
+// commit writes `files` (path to contents, an empty content removes the file)
+// and returns the sha of the new commit.
+func (r *testRepo) commit(files map[string]string) string {
+	for path, contents := range files {
+		if contents == "" {
+			r.git("rm", "--quiet", path)
+			continue
+		}
+		assert.NilError(r.t, os.MkdirAll(filepath.Join(r.dir, filepath.Dir(path)), 0o755))
+		assert.NilError(r.t, os.WriteFile(filepath.Join(r.dir, path), []byte(contents), 0o644))
+		r.git("add", path)
+	}
+	r.git("commit", "--quiet", "--allow-empty", "-m", "commit")
+	return r.git("rev-parse", "HEAD")
+}
+
+func TestMirrors(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	first := repo.commit(map[string]string{"README.md": "pocketci", "main.go": "package main"})
+	second := repo.commit(map[string]string{"main.go": "package main\n"})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+
+	mirror, err := mirrors.Fetch(ctx, repo.url(), second, "refs/heads/main")
+	assert.NilError(t, err)
+	assert.Assert(t, mirror.HasCommit(ctx, first))
+
+	changes, err := mirror.Diff(ctx, second, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "main.go", Status: ChangeModified}})
+
+	// root commits report every file
+	changes, err = mirror.Diff(ctx, first, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "README.md", Status: ChangeAdded}, {Path: "main.go", Status: ChangeAdded}})
+
+	// fetching again only brings the new commits
+	third := repo.commit(map[string]string{"docs/index.md": "docs"})
+	mirror, err = mirrors.Fetch(ctx, repo.url(), third, "refs/heads/main")
+	assert.NilError(t, err)
+
+	changes, err = mirror.Diff(ctx, third, first)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "docs/index.md", Status: ChangeAdded}, {Path: "main.go", Status: ChangeModified}})
+
+	// renames and deletions are reported with their status
+	fourth := repo.commit(map[string]string{"README.md": "", "docs/index.md": ""})
+	repo.git("mv", "main.go", "cmd.go")
+	fifth := repo.commit(nil)
+	mirror, err = mirrors.Fetch(ctx, repo.url(), fifth, "refs/heads/main")
+	assert.NilError(t, err)
+
+	changes, err = mirror.Diff(ctx, fifth, third)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{
+		{Path: "README.md", Status: ChangeDeleted},
+		{Path: "cmd.go", OldPath: "main.go", Status: ChangeRenamed},
+		{Path: "docs/index.md", Status: ChangeDeleted},
+	})
+	assert.Assert(t, mirror.HasCommit(ctx, fourth))
+
+	dir, remove, err := mirror.Checkout(ctx, second, CheckoutOptions{})
+	assert.NilError(t, err)
+	contents, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(contents), "package main\n")
+	_, err = os.Stat(filepath.Join(dir, "docs"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	remove()
+	_, err = os.Stat(dir)
+	assert.Assert(t, os.IsNotExist(err))
+}
+
+func TestMirrorMergeBase(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"README.md": "pocketci"})
+	branchOff := repo.commit(map[string]string{"main.go": "package main"})
+
+	repo.git("checkout", "--quiet", "-b", "feature")
+	repo.commit(map[string]string{"feature.go": "package main"})
+	head := repo.commit(map[string]string{"feature_test.go": "package main"})
+
+	// the base branch moves on long after the feature branched off
+	repo.git("checkout", "--quiet", "main")
+	for i := 0; i < 5; i++ {
+		repo.commit(map[string]string{"CHANGELOG.md": strings.Repeat("entry\n", i+1)})
+	}
+	base := repo.git("rev-parse", "HEAD")
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	mirrors.Depth = 1
+
+	mirror, err := mirrors.Fetch(ctx, repo.url(), head, "refs/heads/feature", "refs/heads/main")
+	assert.NilError(t, err)
+	assert.Assert(t, mirror.isShallow(ctx))
+
+	mergeBase, err := mirror.MergeBase(ctx, head, base)
+	assert.NilError(t, err)
+	assert.Equal(t, mergeBase, branchOff)
+
+	changes, err := mirror.Diff(ctx, head, mergeBase)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "feature.go", Status: ChangeAdded}, {Path: "feature_test.go", Status: ChangeAdded}})
+
+	// later fetches don't shorten the history the mirror was deepened to
+	repo.commit(map[string]string{"CHANGELOG.md": "release\n"})
+	mirror, err = mirrors.Fetch(ctx, repo.url(), "", "refs/heads/feature", "refs/heads/main")
+	assert.NilError(t, err)
+	_, err = mirror.git(ctx, "merge-base", head, "refs/heads/main")
+	assert.NilError(t, err)
+}
+
+func TestMirrorSubmodules(t *testing.T) {
+	// submodules are cloned from local repositories in the test
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "protocol.file.allow")
+	t.Setenv("GIT_CONFIG_VALUE_0", "always")
+
+	ctx := context.Background()
+	proto := newTestRepo(t)
+	proto.commit(map[string]string{"service.proto": "syntax = \"proto3\";"})
+
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"main.go": "package main"})
+	repo.git("submodule", "add", "--quiet", proto.url(), "proto")
+	added := repo.commit(nil)
+
+	proto.commit(map[string]string{"events.proto": "syntax = \"proto3\";"})
+	repo.git("-C", "proto", "pull", "--quiet", "origin", "main")
+	repo.git("add", "proto")
+	bumped := repo.commit(nil)
+
+	repo.git("rm", "--quiet", "proto")
+	removed := repo.commit(nil)
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+
+	mirror, err := mirrors.Fetch(ctx, repo.url(), removed, "refs/heads/main")
+	assert.NilError(t, err)
+
+	changes, err := mirror.SubmoduleDiff(ctx, added, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "proto/service.proto", Status: ChangeAdded}})
+
+	changes, err = mirror.SubmoduleDiff(ctx, bumped, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "proto/events.proto", Status: ChangeAdded}})
+
+	changes, err = mirror.SubmoduleDiff(ctx, removed, "")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{
+		{Path: "proto/events.proto", Status: ChangeDeleted},
+		{Path: "proto/service.proto", Status: ChangeDeleted},
+	})
+
+	changes, err = mirror.SubmoduleDiff(ctx, removed, added)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes, []Change{{Path: "proto/service.proto", Status: ChangeDeleted}})
+
+	dir, remove, err := mirror.Checkout(ctx, bumped, CheckoutOptions{Submodules: true})
+	assert.NilError(t, err)
+	defer remove()
+
+	_, err = os.Stat(filepath.Join(dir, "proto", "events.proto"))
+	assert.NilError(t, err)
+}
+
+func TestMirrorSparseCheckout(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	repo.git("config", "uploadpack.allowFilter", "true")
+	repo.git("config", "uploadpack.allowAnySHA1InWant", "true")
+	sha := repo.commit(map[string]string{
+		"pocketci.yaml":         "module-path: ci",
+		"ci/dagger.json":        "{}",
+		"apps/api/main.go":      "package main",
+		"apps/web/index.html":   "<html></html>",
+		"apps/web/main_test.go": "package main",
+	})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	mirrors.Blobless = true
+
+	mirror, err := mirrors.Fetch(ctx, repo.url(), sha, "refs/heads/main")
+	assert.NilError(t, err)
+
+	// blobless mirrors still know which files changed
+	changes, err := mirror.Diff(ctx, sha, "")
+	assert.NilError(t, err)
+	assert.Equal(t, len(changes), 5)
+
+	dir, remove, err := mirror.Checkout(ctx, sha, CheckoutOptions{Paths: []string{".", "ci", "apps/**/*.go"}})
+	assert.NilError(t, err)
+	defer remove()
+
+	for file, exists := range map[string]bool{
+		"pocketci.yaml":         true,
+		"ci/dagger.json":        true,
+		"apps/api/main.go":      true,
+		"apps/web/main_test.go": true,
+		"apps/web/index.html":   false,
+	} {
+		_, err := os.Stat(filepath.Join(dir, file))
+		assert.Equal(t, err == nil, exists, file)
+	}
+
+	// sparse checkouts don't affect other worktrees
+	full, removeFull, err := mirror.Checkout(ctx, sha, CheckoutOptions{})
+	assert.NilError(t, err)
+	defer removeFull()
+
+	_, err = os.Stat(filepath.Join(full, "apps/web/index.html"))
+	assert.NilError(t, err)
+}
+
+func TestSparsePatterns(t *testing.T) {
+	cases := []struct {
+		name     string
+		paths    []string
+		expected []string
+	}{
+		{name: "directories", paths: []string{"ci", "./apps/api/"}, expected: []string{"/ci", "/apps/api"}},
+		{name: "globs", paths: []string{"apps/**/*.go"}, expected: []string{"/apps/**/*.go"}},
+		{name: "root", paths: []string{"ci", "."}, expected: []string{"/*", "!/*/", "/ci"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, sparsePatterns(tc.paths), tc.expected)
+		})
+	}
+}
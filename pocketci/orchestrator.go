@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
+	"path"
 	"slices"
 	"strings"
 	"time"
@@ -14,7 +16,6 @@ import (
 	"dagger.io/dagger"
 	"github.com/bmatcuk/doublestar"
 	"github.com/google/go-github/v61/github"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -25,9 +26,24 @@ const (
 
 type Orchestrator struct {
 	Dispatcher Dispatcher
-	dag        *dagger.Client
-
-	GithubNetrc *dagger.Secret
+	Runs       *RunStore
+	Mirrors    *Mirrors
+	// Snapshots stores the trees checked out for the pipelines so agents
+	// don't need to fetch the repositories. Disabled when nil.
+	Snapshots *Snapshots
+	// Secrets are the backends the secrets of specs are looked up from.
+	// Defaults to `DefaultSecretBackends()` when nil.
+	Secrets *SecretBackends
+	// Variables are injected into the pipelines of every event.
+	Variables *Variables
+	// Includes reads the specs included by the specs of the repositories.
+	// Specs can't include others when nil.
+	Includes *SpecIncludes
+	dag      *dagger.Client
+
+	// SkipToken is honored on top of `[skip ci]` and `[ci skip]` to skip the
+	// pipelines of an event.
+	SkipToken string
 }
 
 func (o *Orchestrator) Handle(ctx context.Context, wh *Webhook) error {
@@ -45,40 +61,333 @@ func (o *Orchestrator) Handle(ctx context.Context, wh *Webhook) error {
 }
 
 func (o *Orchestrator) HandleGithub(ctx context.Context, wh *Webhook) error {
-	event, err := o.handleGithubEvent(ctx, wh.EventType, wh.Payload)
+	event, err := parseGithubEvent(wh.EventType, wh.Payload)
+	if err != nil {
+		return err
+	}
+
+	run := o.Runs.Create(&Run{
+		Repository: event.RepositoryName,
+		EventType:  event.EventType,
+		GitInfo:    event.GitInfo(),
+	})
+	if err := o.handleGithubRun(ctx, run, event); err != nil {
+		o.Runs.Update(run.ID, func(r *Run) {
+			r.Error = err.Error()
+		})
+		return err
+	}
+	return nil
+}
+
+func (o *Orchestrator) handleGithubRun(ctx context.Context, run *Run, event *GithubEvent) error {
+	// pipelines that tested the merge of a pull request are outdated as soon
+	// as its base branch moves, even if the push itself is skipped
+	if event.PushEvent != nil {
+		o.markStale(ctx, event)
+	}
+
+	// skip directives are checked before cloning so skipped events are as
+	// cheap as possible
+	if token := skipDirective(event.Message(), o.SkipToken); token != "" {
+		slog.Info("skipping event", slog.String("repository", event.RepositoryName),
+			slog.String("sha", event.SHA), slog.String("directive", token))
+		o.Runs.Update(run.ID, func(r *Run) {
+			r.SkipReason = fmt.Sprintf("found %s directive", token)
+		})
+		return nil
+	}
+
+	if event.PushEvent.GetDeleted() {
+		slog.Info("skipping event of deleted branch", slog.String("repository", event.RepositoryName),
+			slog.String("branch", event.Branch))
+		o.Runs.Update(run.ID, func(r *Run) {
+			r.SkipReason = "branch was deleted"
+		})
+		return nil
+	}
+
+	if err := o.checkout(ctx, event); err != nil {
+		return err
+	}
+
+	specs, err := readSpecs(ctx, event.mirror, event.SHA, event.Spec, o.Includes)
+	if err != nil {
+		return err
+	}
+
+	specs = matchSpecs(event, specs)
+	if len(specs) == 0 {
+		o.Runs.Update(run.ID, func(r *Run) {
+			r.SkipReason = "no changed file matches the paths of any spec"
+		})
+		return nil
+	}
+
+	opts := event.Spec.Checkout.Options()
+	opts.Paths = discoveryPaths(opts, specs)
+	event.Repository, err = event.mirror.Snapshot(ctx, o.dag, event.SHA, opts)
+	if err != nil {
+		return err
+	}
+
+	pipelines, err := o.discover(ctx, event, specs)
 	if err != nil {
 		return err
 	}
 
-	module, err := getDispatchModule(ctx, event.Repository.File("pocketci.yaml"))
+	// invalid pipelines are skipped so they don't keep the valid ones from
+	// running, `pocketci validate` reports them before they are pushed
+	pipelines, invalid := skipInvalidPipelines(pipelines)
+
+	pipelines, skipped, err := matchPipelines(event, pipelines)
 	if err != nil {
 		return err
 	}
+	skipped = append(invalid, skipped...)
 
-	fn, err := hasFunction(ctx, event.Repository.Directory(module).AsModule(), "pocketciPipelines", "pipelines", "dispatch")
+	pipelines, mergeSkipped, err := o.resolveMergeRef(ctx, event, pipelines)
 	if err != nil {
 		return err
 	}
+	skipped = append(skipped, mergeSkipped...)
 
-	// with the function we now need to get the dagger file that it returns
-	// containing all the workflows the user has configured
-	pipelines, err := o.getPipelines(ctx, event, fn)
+	pipelines, err = expandMatrices(pipelines)
 	if err != nil {
 		return err
 	}
 
+	if err := renderPipelines(event, pipelines); err != nil {
+		return err
+	}
+
+	for _, p := range pipelines {
+		p.Paths = checkoutPaths(p, event.Spec)
+		p.variables = maps.Clone(event.Variables)
+		maps.Copy(p.variables, p.Env)
+	}
+
+	if err := o.snapshot(ctx, event, pipelines); err != nil {
+		return err
+	}
+
+	for _, p := range skipped {
+		slog.Info("skipping pipeline", slog.String("repository", event.RepositoryName),
+			slog.String("pipeline", p.Name), slog.String("reason", p.Reason))
+	}
+
+	o.Runs.Update(run.ID, func(r *Run) {
+		r.GitInfo = event.GitInfo()
+		r.SkippedPipelines = skipped
+		r.Calls = map[string][]string{}
+		for _, p := range pipelines {
+			r.Pipelines = append(r.Pipelines, p.Name)
+			r.Calls[p.Name] = p.Exec
+		}
+	})
+
 	slog.Info("dispatching pipelines", slog.Int("pipelines", len(pipelines)))
-	return o.Dispatcher.Dispatch(ctx, GitInfo{Branch: event.Branch, SHA: event.SHA}, pipelines)
+	return o.Dispatcher.Dispatch(ctx, event.GitInfo(), pipelines)
+}
+
+// matchSpecs returns the specs whose paths match the changes of the event.
+func matchSpecs(event *GithubEvent, specs []*Spec) []*Spec {
+	matched := []*Spec{}
+	for _, spec := range specs {
+		if !spec.matchPaths(event.Changes) {
+			slog.Info("skipping spec, changes do not match its paths", slog.String("repository", event.RepositoryName),
+				slog.String("sha", event.SHA), slog.String("spec", spec.file))
+			continue
+		}
+		matched = append(matched, spec)
+	}
+	return matched
+}
+
+// discover returns the pipelines of every spec. Each spec gets its own module
+// and secrets, and their pipelines are merged into a single run. Pipelines
+// only get the secrets they declare.
+func (o *Orchestrator) discover(ctx context.Context, event *GithubEvent, specs []*Spec) ([]*Pipeline, error) {
+	pipelines := []*Pipeline{}
+	definedBy := map[string]string{}
+	for _, spec := range specs {
+		secrets, err := spec.resolveSecrets(ctx, o.Secrets, event)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.file, err)
+		}
+		// the discovery runs the code of the event, so it only gets the
+		// secrets the event can use
+		discoverySecrets := spec.allowedSecrets(event, secrets)
+
+		fn, err := hasFunction(ctx, event.Repository.Directory(spec.ModulePath).AsModule(), "pocketciPipelines", "pipelines", "dispatch")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.file, err)
+		}
+
+		// with the function we now need to get the dagger file that it
+		// returns containing all the workflows the user has configured
+		specPipelines, err := o.getPipelines(ctx, event, spec, fn, discoverySecrets)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.file, err)
+		}
+
+		for _, p := range specPipelines {
+			if other, ok := definedBy[p.Name]; ok {
+				return nil, fmt.Errorf("pipeline %s is defined by both %s and %s", p.Name, other, spec.file)
+			}
+			definedBy[p.Name] = spec.file
+
+			p.spec = spec
+			p.secrets, err = spec.scopeSecrets(p, secrets)
+			if err != nil {
+				return nil, err
+			}
+		}
+		pipelines = append(pipelines, specPipelines...)
+	}
+	return pipelines, nil
+}
+
+// resolveMergeRef fetches the merge ref of the pull request when any of the
+// pipelines, or the spec of the repository, asks to test the result of merging
+// the pull request instead of its head. Those pipelines are skipped when
+// github does not provide a merge ref, e.g. because of conflicts.
+func (o *Orchestrator) resolveMergeRef(ctx context.Context, event *GithubEvent, pipelines []*Pipeline) ([]*Pipeline, []SkippedPipeline, error) {
+	if event.PullRequestEvent == nil {
+		return pipelines, nil, nil
+	}
+
+	wantsMergeRef := false
+	for _, p := range pipelines {
+		p.MergeRef = p.MergeRef || event.Spec.Checkout.Options().MergeRef
+		wantsMergeRef = wantsMergeRef || p.MergeRef
+	}
+	if !wantsMergeRef {
+		return pipelines, nil, nil
+	}
+
+	ref := fmt.Sprintf("refs/pull/%d/merge", event.PullRequestEvent.GetNumber())
+	sha, err := event.mirror.FetchRef(ctx, ref)
+	if err == nil {
+		event.MergeRef, event.MergeSHA = ref, sha
+		return pipelines, nil, nil
+	}
+
+	slog.Info("merge ref is not available", slog.String("repository", event.RepositoryName),
+		slog.String("ref", ref), slog.String("error", err.Error()))
+	run := []*Pipeline{}
+	skipped := []SkippedPipeline{}
+	for _, p := range pipelines {
+		if p.MergeRef {
+			skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: ref + " is not available, the pull request might have conflicts"})
+			continue
+		}
+		run = append(run, p)
+	}
+	return run, skipped, nil
+}
+
+// checkoutPaths returns the paths checked out for the pipeline: its module
+// plus the paths it declares or, when the repository enables sparse
+// checkouts, the paths of its `OnChanges` filters. The whole repository is
+// checked out when nil is returned.
+func checkoutPaths(p *Pipeline, spec *Spec) []string {
+	module := p.Module
+	if module == "" {
+		module = "."
+	}
+
+	if len(p.Paths) > 0 {
+		return append([]string{module}, p.Paths...)
+	}
+	// the module of the root needs the whole repository
+	if !spec.Checkout.Options().Sparse || path.Clean(module) == "." {
+		return nil
+	}
+	return append([]string{module}, p.Changes...)
+}
+
+// snapshot stores the tree each pipeline checks out so agents can download
+// it. Pipelines that check out the same tree share the snapshot.
+func (o *Orchestrator) snapshot(ctx context.Context, event *GithubEvent, pipelines []*Pipeline) error {
+	if o.Snapshots == nil {
+		return nil
+	}
+
+	digests := map[string]string{}
+	for _, p := range pipelines {
+		sha := event.SHA
+		if p.MergeRef {
+			sha = event.MergeSHA
+		}
+
+		key := strings.Join(append([]string{sha}, p.Paths...), "\x00")
+		if _, ok := digests[key]; !ok {
+			opts := event.Spec.Checkout.Options()
+			opts.Paths = p.Paths
+			dir, remove, err := event.mirror.Checkout(ctx, sha, opts)
+			if err != nil {
+				return err
+			}
+
+			digest, err := o.Snapshots.Create(dir)
+			remove()
+			if err != nil {
+				return err
+			}
+
+			slog.Info("created snapshot", slog.String("repository", event.RepositoryName),
+				slog.String("sha", sha), slog.String("digest", digest))
+			digests[key] = digest
+		}
+		p.Snapshot = digests[key]
+	}
+
+	return nil
+}
+
+// markStale flags the pipelines that tested the merge of a pull request
+// against the branch the push event moved.
+func (o *Orchestrator) markStale(ctx context.Context, event *GithubEvent) {
+	stale := o.Dispatcher.MarkStale(ctx, event.RepositoryName, event.Branch, event.SHA)
+	if len(stale) == 0 {
+		return
+	}
+
+	slog.Info("base branch moved, pipelines need to be re-run", slog.String("repository", event.RepositoryName),
+		slog.String("branch", event.Branch), slog.Int("pipelines", len(stale)))
+	o.Runs.MarkStale(event.RepositoryName, event.Branch, event.SHA)
 }
 
-func (o *Orchestrator) getPipelines(ctx context.Context, event *GithubEvent, fn string) ([]*Pipeline, error) {
+func (o *Orchestrator) getPipelines(ctx context.Context, event *GithubEvent, spec *Spec, fn string, secrets map[string]string) ([]*Pipeline, error) {
+	module := spec.ModulePath
+	trigger, err := event.EventTrigger()
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := functionArgs(ctx, event.Repository.Directory(module).AsModule(), fn)
+	if err != nil {
+		return nil, err
+	}
+
 	stdout, err := AgentContainer(o.dag).
 		WithEnvVariable("CACHE_BUST", time.Now().String()).
 		WithEnvVariable("DAGGER_CLOUD_TOKEN", os.Getenv("DAGGER_CLOUD_TOKEN")).
 		WithDirectory("/"+event.RepositoryName, event.Repository).
-		WithWorkdir("/" + event.RepositoryName).
+		WithWorkdir("/"+event.RepositoryName).
+		WithNewFile(EventTriggerPath, string(trigger)).
+		With(WithVariables(event.Variables)).
+		With(WithSecrets(o.dag, event.RepositoryName, secrets)).
 		With(func(c *dagger.Container) *dagger.Container {
-			call := fmt.Sprintf("dagger call -vvv --progress plain %s contents", fn)
+			call := fmt.Sprintf("dagger call -m %s -vvv --progress plain %s", module, fn)
+			if slices.Contains(args, "eventTrigger") {
+				call += " --event-trigger " + EventTriggerPath
+			}
+			if flags := spec.secretArgs(args, secrets); len(flags) > 0 {
+				call += " " + strings.Join(flags, " ")
+			}
+			call += " contents"
 			script := fmt.Sprintf("unset TRACEPARENT;unset OTEL_EXPORTER_OTLP_PROTOCOL=http/protobuf;unset OTEL_EXPORTER_OTLP_ENDPOINT=http://127.0.0.1:38015;unset OTEL_EXPORTER_OTLP_TRACES_PROTOCOL=http/protobuf;unset OTEL_EXPORTER_OTLP_TRACES_ENDPOINT=http://127.0.0.1:38015/v1/traces;unset OTEL_EXPORTER_OTLP_TRACES_LIVE=1;unset OTEL_EXPORTER_OTLP_LOGS_PROTOCOL=http/protobuf;unset OTEL_EXPORTER_OTLP_LOGS_ENDPOINT=http://127.0.0.1:38015/v1/logs;unset OTEL_EXPORTER_OTLP_METRICS_PROTOCOL=http/protobuf;unset OTEL_EXPORTER_OTLP_METRICS_ENDPOINT=http://127.0.0.1:38015/v1/metrics; %s", call)
 			return c.WithExec([]string{"sh", "-c", script}, dagger.ContainerWithExecOpts{
 				ExperimentalPrivilegedNesting: true,
@@ -94,53 +403,136 @@ func (o *Orchestrator) getPipelines(ctx context.Context, event *GithubEvent, fn
 		return nil, err
 	}
 
+	for _, p := range pipelines {
+		p.EventTrigger = trigger
+	}
+
+	return pipelines, nil
+}
+
+// WithSecrets exposes `secrets` of `repository` to the calls made in the
+// container as environment variables, see `SecretEnv`.
+func WithSecrets(dag *dagger.Client, repository string, secrets map[string]string) dagger.WithContainerFunc {
+	return func(c *dagger.Container) *dagger.Container {
+		for _, name := range slices.Sorted(maps.Keys(secrets)) {
+			// secrets are named after the repository as different
+			// repositories can use the same name for different values
+			c = c.WithSecretVariable(SecretEnv(name), dag.SetSecret(repository+"-"+name, secrets[name]))
+		}
+		return c
+	}
+}
+
+// matchPipelines returns the pipelines that should run for `event` together
+// with the pipelines that were skipped and why.
+func matchPipelines(event *GithubEvent, pipelines []*Pipeline) ([]*Pipeline, []SkippedPipeline, error) {
 	run := []*Pipeline{}
+	skipped := []SkippedPipeline{}
 	for _, p := range pipelines {
 		// only match pipelines when list of changes is empty or matches the
 		// files that changed
-		if len(p.Changes) != 0 && !Match(event.Changes, p.Changes...) {
+		if !matchChanges(event.Changes, p) {
+			continue
+		}
+
+		if token := pipelineSkipDirective(event.Message(), p.Name); token != "" {
+			skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: fmt.Sprintf("found %s directive", token)})
 			continue
 		}
 
 		p.Repository = event.RepositoryName
 
 		switch {
-		case event.PullRequestEvent != nil && p.OnPR && (len(p.Actions) == 0 || slices.Contains(p.Actions, *event.PullRequestEvent.Action)):
+		case event.PullRequestEvent != nil && p.OnPR && matchPullRequestAction(p, event.PullRequestEvent.GetAction()) &&
+			matchBaseBranch(p, event.BaseBranch):
+			if p.SkipDrafts && event.PullRequestEvent.GetPullRequest().GetDraft() {
+				skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: "pull request is a draft"})
+				continue
+			}
+
 			// if the pipeline has also configured a Push trigger that matches
 			// the branches then we skip this event to avoid duplicates
 			if p.OnPush && (len(p.Branches) == 0 || slices.Contains(p.Branches, *event.PullRequestEvent.PullRequest.Head.Ref)) {
-				return nil, errors.New("pull request pipeline is already matched by push event")
+				return nil, nil, errors.New("pull request pipeline is already matched by push event")
 			}
 
 			// received a pull request and the pipeline targets the PR
 			slog.Debug("pipeline matched on pull request event", slog.String("repository", event.RepositoryName),
 				slog.String("action", *event.PullRequestEvent.Action), slog.String("pipeline", p.Name))
 			run = append(run, p)
-		case event.PushEvent != nil && p.OnPush && (len(p.Branches) == 0 || slices.Contains(p.Branches, event.PushEvent.GetRef()[11:])):
+		case event.PushEvent != nil && p.OnPush && (len(p.Branches) == 0 || slices.Contains(p.Branches, event.Branch)):
 			// received a push event and the pipeline targets push event
 			slog.Debug("pipeline matched on push event", slog.String("repository", event.RepositoryName),
 				slog.String("ref", *event.PushEvent.Ref), slog.String("pipeline", p.Name))
 			run = append(run, p)
+		case !p.OnPR && !p.OnPush && p.If != "":
+			// pipelines without triggers only depend on their condition
+			run = append(run, p)
 		default:
-			return nil, errors.New("unhandled event")
+			slog.Debug("pipeline does not match event", slog.String("repository", event.RepositoryName),
+				slog.String("event", event.EventType), slog.String("pipeline", p.Name))
+		}
+	}
+
+	// pipelines that declare secrets the event can't use are skipped instead
+	// of running without them
+	allowed := []*Pipeline{}
+	for _, p := range run {
+		if p.If != "" {
+			cond, err := ParseCondition(p.If)
+			if err != nil {
+				return nil, nil, fmt.Errorf("pipeline %s: %w", p.Name, err)
+			}
+			if !cond.Eval(event) {
+				skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: fmt.Sprintf("condition %s is false", cond)})
+				continue
+			}
+		}
+
+		if p.spec != nil {
+			if secret, denied := p.spec.deniedSecret(event, p); denied {
+				reason := fmt.Sprintf("secret %s is not allowed for %s events on branch %s", secret, event.EventType, event.secretsBranch())
+				if event.fromFork() {
+					reason = fmt.Sprintf("secret %s is not allowed for pull requests from forks", secret)
+				}
+				skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: reason})
+				continue
+			}
 		}
+		allowed = append(allowed, p)
 	}
 
-	return run, nil
+	return allowed, skipped, nil
+}
+
+// matchPullRequestAction reports whether the pull request `action` triggers
+// the pipeline. Pipelines that skip drafts are deferred until the pull request
+// is ready for review, so that action triggers them as well.
+func matchPullRequestAction(p *Pipeline, action string) bool {
+	if p.SkipDrafts && action == GithubReadyForReview {
+		return true
+	}
+	return len(p.Actions) == 0 || slices.Contains(p.Actions, action)
 }
 
-func (o *Orchestrator) handleGithubEvent(ctx context.Context, eventType string, payload json.RawMessage) (*GithubEvent, error) {
+// matchBaseBranch reports whether pull requests against `baseBranch` trigger
+// the pipeline. Base branches can be globs, e.g. `release/*`.
+func matchBaseBranch(p *Pipeline, baseBranch string) bool {
+	return len(p.BaseBranches) == 0 || Match([]string{baseBranch}, p.BaseBranches...)
+}
+
+// parseGithubEvent parses the webhook payload. It does not clone the repository,
+// that is done by `checkout` once we know the event should be handled.
+func parseGithubEvent(eventType string, payload json.RawMessage) (*GithubEvent, error) {
 	githubEvent, err := github.ParseWebHook(eventType, payload)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		gh = &GithubEvent{
-			EventType: eventType,
-		}
-		baseRef, baseSha string
-	)
+	gh := &GithubEvent{
+		RawPayload: payload,
+		EventType:  eventType,
+	}
 	switch ghEvent := githubEvent.(type) {
 	case *github.PullRequestEvent:
 		gh.PullRequestEvent = ghEvent
@@ -148,107 +540,220 @@ func (o *Orchestrator) handleGithubEvent(ctx context.Context, eventType string,
 		gh.SHA = *ghEvent.PullRequest.Head.SHA
 		gh.RepositoryName = *ghEvent.Repo.FullName
 		gh.Branch = branchName(*ghEvent.PullRequest.Head.Ref)
-		baseRef = branchName(*ghEvent.PullRequest.Base.Ref)
-		baseSha = *ghEvent.PullRequest.Base.SHA
+		// the head branch might live in a fork, the pull request ref is
+		// always available in the base repository
+		gh.Ref = fmt.Sprintf("refs/pull/%d/head", ghEvent.GetNumber())
+		gh.BaseBranch = branchName(*ghEvent.PullRequest.Base.Ref)
+		gh.BaseSHA = *ghEvent.PullRequest.Base.SHA
 	case *github.PushEvent:
 		gh.PushEvent = ghEvent
 
-		gh.SHA = *ghEvent.HeadCommit.ID
-		gh.Branch = branchName(*ghEvent.Head)
+		gh.SHA = ghEvent.GetAfter()
+		gh.RepositoryName = ghEvent.GetRepo().GetFullName()
+		gh.Branch = branchName(ghEvent.GetRef())
+		gh.Ref = ghEvent.GetRef()
 	default:
 		return nil, fmt.Errorf("received event of type %T that is not yet supported", ghEvent)
 	}
 
-	ct := BaseContainer(o.dag).
-		WithEnvVariable("CACHE_BUST", time.Now().String()).
-		WithMountedSecret("/root/.netrc", o.GithubNetrc)
-	gh.Repository, gh.Changes, err = cloneAndDiff(ctx, ct, "https://github.com/"+gh.RepositoryName, gh.Branch, gh.SHA, baseRef, baseSha)
+	return gh, nil
+}
+
+// checkout clones the repository of the event and computes the list of files
+// that changed.
+func (o *Orchestrator) checkout(ctx context.Context, gh *GithubEvent) error {
+	base, baseRefs := gh.changesBase()
+	refs := append([]string{gh.Ref}, baseRefs...)
+
+	slog.Info("cloning repository", slog.String("repository", gh.RepositoryName), slog.String("refs", strings.Join(refs, ",")),
+		slog.String("sha", gh.SHA), slog.String("base", base))
+	var err error
+	gh.mirror, err = o.Mirrors.Fetch(ctx, GithubURL(gh.RepositoryName), gh.SHA, refs...)
 	if err != nil {
-		return nil, fmt.Errorf("could not clond and diff repository: %s", err)
+		return fmt.Errorf("could not fetch repository: %s", err)
 	}
 
-	gh.Variables = map[string]string{
+	gh.Spec, err = readSpec(ctx, gh.mirror, gh.SHA, SpecFile, o.Includes)
+	if err != nil {
+		return err
+	}
+
+	base = gh.fetchChangesBase(ctx, base)
+	gh.Changes, err = diffChanges(ctx, gh.mirror, gh.SHA, base, gh.Spec.Checkout.Options())
+	if err != nil {
+		return fmt.Errorf("could not diff repository: %s", err)
+	}
+
+	gh.Variables = o.Variables.Resolve(gh.RepositoryName, gh.Branch)
+	maps.Copy(gh.Variables, map[string]string{
 		"GITHUB_SHA":        gh.SHA,
 		"GITHUB_ACTIONS":    "true",
 		"GITHUB_EVENT_NAME": gh.EventType,
 		"GITHUB_EVENT_PATH": "/raw-payload.json",
 		"GITHUB_REF":        gh.Branch,
-	}
+	})
 
-	return gh, nil
+	return nil
 }
 
-func branchName(branch string) string {
-	v := strings.TrimPrefix(branch, "refs/heads/")
-	return strings.TrimPrefix(v, "refs/pull/")
+// changesBase returns the revision the changes of the event are computed
+// against, together with the refs that need to be fetched to resolve it.
+// Pull requests are compared against their base. Pushes are compared against
+// the commit the branch pointed to before the push, so every pushed commit is
+// considered. New branches are compared against the default branch.
+func (gh *GithubEvent) changesBase() (string, []string) {
+	switch {
+	case gh.PullRequestEvent != nil:
+		return gh.BaseSHA, []string{"refs/heads/" + gh.BaseBranch}
+	case gh.PushEvent != nil:
+		if before := gh.PushEvent.GetBefore(); before != "" && strings.Trim(before, "0") != "" {
+			return before, nil
+		}
+		return gh.defaultBranchBase()
+	default:
+		return "", nil
+	}
 }
 
-// cloneAndDiff clones the repository at `ref` and checks out `sha`. It returns
-// its contents plus the list of files that changed. If `baseRef` is specified
-// we compare the ref:sha against it. If not we compare HEAD against the previous
-// commit.
-// `ct` is a container with git and relevant credentials already configured.
-func cloneAndDiff(ctx context.Context, ct *dagger.Container, url, ref, sha, baseRef, baseSha string) (*dagger.Directory, []string, error) {
-	slog.Info("cloning repository", slog.String("repository", url), slog.String("ref", ref), slog.String("sha", sha), slog.String("base_ref", baseRef), slog.String("base_sha", baseSha))
-
-	// NOTE: it is important that we check out the repository with at least some
-	// history. We need at least two commits (or just one if its the initial commit)
-	// in order to compute the list of changes of the latest commit. We use
-	// a manual git clone instead of dagger's builtin dag.Git function because
-	// of this requirement.
-	dir, err := ct.
-		WithExec([]string{"git", "clone", "--single-branch", "--branch", ref, "--depth", "10", url, "/app"}).
-		WithWorkdir("/app").
-		WithExec([]string{"git", "checkout", sha}).
-		Directory("/app").
-		Sync(ctx)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var filesChanged string
-	// if there is a baseRef then we need to make a comparisson of all the files
-	// being changed
-	if baseRef != "" {
-		filesChanged, err = ct.
-			WithDirectory("/app", dir).
-			WithWorkdir("/app").
-			WithExec([]string{"git", "fetch", "origin", baseRef}).
-			WithExec([]string{"git", "diff-tree", "--no-commit-id", "--name-only", "-r", "HEAD", baseSha}).
-			Stdout(ctx)
-		if err != nil {
-			return nil, nil, err
+// defaultBranchBase returns the default branch of the repository of a push as
+// the base of its changes, or no base when the default branch was pushed.
+func (gh *GithubEvent) defaultBranchBase() (string, []string) {
+	defaultBranch := gh.PushEvent.GetRepo().GetDefaultBranch()
+	if defaultBranch == "" || defaultBranch == gh.Branch {
+		return "", nil
+	}
+	return "refs/heads/" + defaultBranch, []string{"refs/heads/" + defaultBranch}
+}
+
+// fetchChangesBase makes sure the commit a branch pointed to before a push is
+// in the mirror. After a force push that commit might be gone upstream, the
+// push is then compared like a new branch would be.
+func (gh *GithubEvent) fetchChangesBase(ctx context.Context, base string) string {
+	if gh.PushEvent == nil || base != gh.PushEvent.GetBefore() {
+		return base
+	}
+
+	err := gh.mirror.FetchCommit(ctx, base)
+	if err == nil {
+		return base
+	}
+	slog.Warn("could not fetch commit before push, comparing against the default branch", slog.String("repository", gh.RepositoryName),
+		slog.String("before", base), slog.String("error", err.Error()))
+
+	base, refs := gh.defaultBranchBase()
+	for _, ref := range refs {
+		if _, err := gh.mirror.FetchRef(ctx, ref); err != nil {
+			slog.Warn("could not fetch default branch, comparing against the previous commit", slog.String("repository", gh.RepositoryName),
+				slog.String("ref", ref), slog.String("error", err.Error()))
+			return ""
 		}
-	} else {
-		filesChanged, err = ct.
-			WithDirectory("/app", dir).
-			WithWorkdir("/app").
-			WithExec([]string{"git", "diff-tree", "--no-commit-id", "--name-only", "-r", "HEAD"}).
-			Stdout(ctx)
 	}
-	if err != nil {
-		return nil, nil, err
+	return base
+}
+
+// EventTrigger returns the contents of the file that describes the event to
+// the modules.
+func (gh *GithubEvent) EventTrigger() ([]byte, error) {
+	return json.Marshal(EventTrigger{
+		EventType:   gh.EventType,
+		Changes:     changedPaths(gh.Changes),
+		FileChanges: gh.Changes,
+		RepoName:    gh.RepositoryName,
+		Payload:     gh.RawPayload,
+	})
+}
+
+// fromFork reports whether the event is a pull request from a fork, whose code
+// can't be trusted with secrets.
+func (gh *GithubEvent) fromFork() bool {
+	if gh.PullRequestEvent == nil {
+		return false
 	}
+	pr := gh.PullRequestEvent.GetPullRequest()
+	return pr.GetHead().GetRepo().GetFullName() != pr.GetBase().GetRepo().GetFullName()
+}
 
-	return dir, strings.Split(strings.TrimSuffix(filesChanged, "\n"), "\n"), nil
+// secretsBranch returns the branch the secrets of the event are restricted
+// by: the pushed branch or the base branch of a pull request.
+func (gh *GithubEvent) secretsBranch() string {
+	if gh.PullRequestEvent != nil {
+		return gh.BaseBranch
+	}
+	return gh.Branch
 }
 
-func getDispatchModule(ctx context.Context, config *dagger.File) (string, error) {
-	if config == nil {
-		return ".", nil
+// Message returns the text written by the user that triggered the event: the
+// head commit message of a push or the title and body of a pull request.
+func (gh *GithubEvent) Message() string {
+	switch {
+	case gh.PullRequestEvent != nil:
+		pr := gh.PullRequestEvent.GetPullRequest()
+		return pr.GetTitle() + "\n" + pr.GetBody()
+	case gh.PushEvent != nil:
+		return gh.PushEvent.GetHeadCommit().GetMessage()
+	default:
+		return ""
 	}
+}
+
+// GitInfo returns the git information that is attached to the pipelines of
+// the event.
+func (gh *GithubEvent) GitInfo() GitInfo {
+	var checkout CheckoutOptions
+	if gh.Spec != nil {
+		checkout = gh.Spec.Checkout.Options()
+	}
+
+	return GitInfo{
+		Checkout:   checkout,
+		Ref:        gh.Ref,
+		MergeRef:   gh.MergeRef,
+		MergeSHA:   gh.MergeSHA,
+		Branch:     gh.Branch,
+		SHA:        gh.SHA,
+		BaseBranch: gh.BaseBranch,
+		BaseSHA:    gh.BaseSHA,
+	}
+}
+
+// GithubURL returns the https url of a github repository given its full name.
+func GithubURL(repository string) string {
+	return "https://github.com/" + repository
+}
 
-	contents, err := config.Contents(ctx)
+func branchName(branch string) string {
+	v := strings.TrimPrefix(branch, "refs/heads/")
+	return strings.TrimPrefix(v, "refs/pull/")
+}
+
+// diffChanges returns the files that changed in `sha`. If `base` is specified
+// we compare `sha` against the merge base of both revisions, so changes that
+// landed on the base after `sha` branched off are not reported. If not we
+// compare `sha` against the previous commit. Files that changed within
+// submodules are reported when they are checked out.
+func diffChanges(ctx context.Context, mirror *Mirror, sha, base string, opts CheckoutOptions) ([]Change, error) {
+	var err error
+	if base != "" {
+		base, err = mirror.MergeBase(ctx, sha, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := mirror.Diff(ctx, sha, base)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	spec := map[string]string{}
-	if err := yaml.Unmarshal([]byte(contents), &spec); err != nil {
-		return "", err
+	if opts.Submodules {
+		submoduleChanges, err := mirror.SubmoduleDiff(ctx, sha, base)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, submoduleChanges...)
 	}
 
-	return spec["module-path"], nil
+	return changes, nil
 }
 
 func Match(files []string, patterns ...string) bool {
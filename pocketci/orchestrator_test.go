@@ -0,0 +1,309 @@
+package pocketci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-github/v61/github"
+	"gotest.tools/v3/assert"
+)
+
+func TestMatchPipelines(t *testing.T) {
+	secretsSpec := &Spec{Secrets: []SecretSpec{
+		{Name: "cacheToken", FromEnv: "CACHE_TOKEN"},
+		{Name: "deployKey", FromEnv: "DEPLOY_KEY", Branches: []string{"main"}, Events: []string{GithubPush}},
+	}}
+	cases := []struct {
+		name      string
+		payload   []byte
+		eventType string
+		message   string
+		action    string
+		draft     bool
+		fork      bool
+		changes   []Change
+		pipelines []*Pipeline
+		expected  []string
+		skipped   []SkippedPipeline
+	}{
+		{
+			name:      "push matches branch",
+			payload:   ghCommitPush,
+			eventType: GithubPush,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPush: true, Branches: []string{"main"}},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{},
+		},
+		{
+			name:      "pipeline skip directive",
+			payload:   ghCommitPush,
+			eventType: GithubPush,
+			message:   "bump dependencies [skip e2e]",
+			pipelines: []*Pipeline{
+				{Name: "test", OnPush: true},
+				{Name: "e2e", OnPush: true},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{{Name: "e2e", Reason: "found [skip e2e] directive"}},
+		},
+		{
+			name:      "pull request matches action",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, Actions: []string{"opened"}},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{},
+		},
+		{
+			name:      "pull request matches base branch",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, BaseBranches: []string{"main"}},
+				{Name: "release", OnPR: true, BaseBranches: []string{"release/*"}},
+				{Name: "any", OnPR: true, BaseBranches: []string{"ma*", "release/*"}},
+			},
+			expected: []string{"test", "any"},
+			skipped:  []SkippedPipeline{},
+		},
+		{
+			name:      "drafts are skipped",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			draft:     true,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, Actions: []string{"opened"}},
+				{Name: "e2e", OnPR: true, Actions: []string{"opened"}, SkipDrafts: true},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{{Name: "e2e", Reason: "pull request is a draft"}},
+		},
+		{
+			name:      "ready for review triggers deferred pipelines",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			action:    GithubReadyForReview,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, Actions: []string{"opened"}},
+				{Name: "e2e", OnPR: true, Actions: []string{"opened"}, SkipDrafts: true},
+			},
+			expected: []string{"e2e"},
+			skipped:  []SkippedPipeline{},
+		},
+		{
+			name:      "changes with status",
+			payload:   ghCommitPush,
+			eventType: GithubPush,
+			changes: []Change{
+				{Path: "migrations/001_init.sql", Status: ChangeModified},
+				{Path: "api/handlers.go", OldPath: "api/handler.go", Status: ChangeRenamed},
+			},
+			pipelines: []*Pipeline{
+				{Name: "migrations", OnPush: true, Changes: []string{"migrations/**"}, ChangeStatuses: []ChangeStatus{ChangeAdded}},
+				{Name: "api", OnPush: true, Changes: []string{"api/handler.go"}},
+				{Name: "renames", OnPush: true, ChangeStatuses: []ChangeStatus{ChangeRenamed}},
+			},
+			expected: []string{"api", "renames"},
+			skipped:  []SkippedPipeline{},
+		},
+		{
+			name:      "conditions",
+			payload:   ghCommitPush,
+			eventType: GithubPush,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPush: true, If: `author == "matipan"`},
+				{Name: "deploy", OnPush: true, If: `branch == "production"`},
+				{Name: "main", If: `branch == "main"`},
+				{Name: "pr", OnPR: true, If: `branch == "main"`},
+			},
+			expected: []string{"test", "main"},
+			skipped:  []SkippedPipeline{{Name: "deploy", Reason: `condition branch == "production" is false`}},
+		},
+		{
+			name:      "secrets restricted to pushes",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, Secrets: []string{"cacheToken"}, spec: secretsSpec},
+				{Name: "deploy", OnPR: true, Secrets: []string{"deployKey"}, spec: secretsSpec},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{{Name: "deploy", Reason: "secret deployKey is not allowed for pull_request events on branch main"}},
+		},
+		{
+			name:      "no secrets for forks",
+			payload:   ghPrOpen,
+			eventType: GithubPullRequest,
+			fork:      true,
+			pipelines: []*Pipeline{
+				{Name: "test", OnPR: true, spec: secretsSpec},
+				{Name: "cache", OnPR: true, Secrets: []string{"cacheToken"}, spec: secretsSpec},
+			},
+			expected: []string{"test"},
+			skipped:  []SkippedPipeline{{Name: "cache", Reason: "secret cacheToken is not allowed for pull requests from forks"}},
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := parseGithubEvent(test.eventType, test.payload)
+			assert.NilError(t, err)
+			if test.message != "" {
+				event.PushEvent.HeadCommit.Message = &test.message
+			}
+			if test.action != "" {
+				event.PullRequestEvent.Action = &test.action
+			}
+			if test.draft {
+				event.PullRequestEvent.PullRequest.Draft = &test.draft
+			}
+			if test.fork {
+				event.PullRequestEvent.PullRequest.Head.Repo.FullName = github.String("someone/pocketci-tester")
+			}
+			event.Changes = test.changes
+
+			pipelines, skipped, err := matchPipelines(event, test.pipelines)
+			assert.NilError(t, err)
+
+			names := []string{}
+			for _, p := range pipelines {
+				names = append(names, p.Name)
+			}
+			assert.DeepEqual(t, names, test.expected)
+			assert.DeepEqual(t, skipped, test.skipped)
+		})
+	}
+}
+
+func TestChangesBase(t *testing.T) {
+	push, err := parseGithubEvent(GithubPush, ghCommitPush)
+	assert.NilError(t, err)
+
+	base, refs := push.changesBase()
+	assert.Equal(t, base, "2ea88817edd2a8bca8d57acb92148e126b6918e9")
+	assert.Equal(t, len(refs), 0)
+
+	// new branches are compared against the default branch
+	zero := "0000000000000000000000000000000000000000"
+	push.PushEvent.Before = &zero
+	push.Branch = "feature"
+	base, refs = push.changesBase()
+	assert.Equal(t, base, "refs/heads/main")
+	assert.DeepEqual(t, refs, []string{"refs/heads/main"})
+
+	// unless the new branch is the default branch itself
+	push.Branch = "main"
+	base, refs = push.changesBase()
+	assert.Equal(t, base, "")
+	assert.Equal(t, len(refs), 0)
+
+	pr, err := parseGithubEvent(GithubPullRequest, ghPrOpen)
+	assert.NilError(t, err)
+
+	base, refs = pr.changesBase()
+	assert.Equal(t, base, pr.BaseSHA)
+	assert.DeepEqual(t, refs, []string{"refs/heads/main"})
+}
+
+func TestFetchChangesBase(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	first := repo.commit(map[string]string{"README.md": "pocketci"})
+	repo.git("checkout", "--quiet", "-b", "feature")
+	second := repo.commit(map[string]string{"main.go": "package main"})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+
+	cases := []struct {
+		name     string
+		branch   string
+		before   string
+		expected string
+	}{
+		{
+			name:     "commit in the mirror",
+			branch:   "feature",
+			before:   first,
+			expected: first,
+		},
+		{
+			name:     "commit gone upstream",
+			branch:   "feature",
+			before:   "2ea88817edd2a8bca8d57acb92148e126b6918e9",
+			expected: "refs/heads/main",
+		},
+		{
+			name:     "commit gone upstream on the default branch",
+			branch:   "main",
+			before:   "2ea88817edd2a8bca8d57acb92148e126b6918e9",
+			expected: "",
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			mirror, err := mirrors.Fetch(ctx, repo.url(), second, "refs/heads/"+test.branch)
+			assert.NilError(t, err)
+
+			event := &GithubEvent{
+				PushEvent: &github.PushEvent{
+					Before: github.String(test.before),
+					Repo:   &github.PushEventRepository{DefaultBranch: github.String("main")},
+				},
+				Branch: test.branch,
+				SHA:    second,
+				mirror: mirror,
+			}
+			base := event.fetchChangesBase(ctx, test.before)
+			assert.Equal(t, base, test.expected)
+
+			_, err = diffChanges(ctx, mirror, second, base, CheckoutOptions{})
+			assert.NilError(t, err)
+		})
+	}
+}
+
+func TestCheckoutPaths(t *testing.T) {
+	sparse := &Spec{ModulePath: "ci", Checkout: SpecCheckout{Sparse: github.Bool(true)}}
+
+	cases := []struct {
+		name     string
+		pipeline *Pipeline
+		spec     *Spec
+		expected []string
+	}{
+		{
+			name:     "whole repository by default",
+			pipeline: &Pipeline{Module: "ci", Changes: []string{"apps/api/**"}},
+			spec:     &Spec{ModulePath: "ci"},
+			expected: nil,
+		},
+		{
+			name:     "declared paths",
+			pipeline: &Pipeline{Module: "ci", Paths: []string{"apps/api"}},
+			spec:     &Spec{ModulePath: "ci"},
+			expected: []string{"ci", "apps/api"},
+		},
+		{
+			name:     "sparse defaults to module and changes",
+			pipeline: &Pipeline{Module: "ci", Changes: []string{"apps/api/**"}},
+			spec:     sparse,
+			expected: []string{"ci", "apps/api/**"},
+		},
+		{
+			name:     "sparse root module",
+			pipeline: &Pipeline{Changes: []string{"apps/api/**"}},
+			spec:     sparse,
+			expected: nil,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, checkoutPaths(tc.pipeline, tc.spec), tc.expected)
+		})
+	}
+}
@@ -1,12 +1,19 @@
 package pocketci
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"time"
 )
 
+// timeOutInterval is how often the server looks for timed out pipelines.
+const timeOutInterval = 10 * time.Second
+
 func (s *Server) PipelineClaimHandler(w http.ResponseWriter, r *http.Request) {
 	req := &PipelineClaimRequest{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
@@ -36,10 +43,119 @@ func (s *Server) PipelineDoneHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.orchestrator.Dispatcher.PipelineDone(r.Context(), pipelineID); err != nil {
+	// agents that don't report a status only report succeeded pipelines
+	req := &PipelineDoneRequest{Status: PipelineSucceeded}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.orchestrator.Dispatcher.PipelineDone(r.Context(), pipelineID, req.Attempt, req.Status, req.Logs)
+	if errors.Is(err, ErrStaleAttempt) {
+		slog.Warn("ignoring report of stale attempt", slog.Int("pipeline", pipelineID), slog.Int("attempt", req.Attempt),
+			slog.String("status", string(req.Status)))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// PipelineStartedHandler records that the call of a pipeline started, so its
+// timeout doesn't count the checkout.
+func (s *Server) PipelineStartedHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.Atoi(r.PathValue("pipeline_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &PipelineStartedRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = s.orchestrator.Dispatcher.PipelineStarted(r.Context(), pipelineID, req.Attempt)
+	if errors.Is(err, ErrStaleAttempt) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PipelineAttemptsHandler returns the status and logs of every attempt of a
+// pipeline.
+func (s *Server) PipelineAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.Atoi(r.PathValue("pipeline_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	attempts, err := s.orchestrator.Dispatcher.Attempts(r.Context(), pipelineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(attempts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// PipelineCancelledHandler tells the agent running an attempt of a pipeline,
+// given by the `attempt` query parameter, whether it has to stop it. Agents
+// poll it while the call runs.
+func (s *Server) PipelineCancelledHandler(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.Atoi(r.PathValue("pipeline_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attempt, err := strconv.Atoi(r.URL.Query().Get("attempt"))
+	if err != nil {
+		http.Error(w, "invalid attempt: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cancelled, err := s.orchestrator.Dispatcher.Cancelled(r.Context(), pipelineID, attempt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(PipelineCancelledResponse{Cancelled: cancelled}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// timeOutPipelines periodically times out the running pipelines whose agents
+// didn't report them in time.
+func (s *Server) timeOutPipelines(ctx context.Context) {
+	ticker := time.NewTicker(timeOutInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, p := range s.orchestrator.Dispatcher.TimeOut(ctx, now) {
+				slog.Warn("pipeline timed out", slog.Int("pipeline", p.ID), slog.String("name", p.Name),
+					slog.String("repository", p.Repository), slog.Duration("timeout", p.Timeout))
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package pocketci
+
+import (
+	"fmt"
+	"maps"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// CallPullRequest is the pull request of the event calls are rendered with.
+// It is empty on push events.
+type CallPullRequest struct {
+	Number int
+	Title  string
+	Author string
+}
+
+// callData returns the data the calls and environment variables of
+// pipelines are rendered with, e.g. `--tag {{.SHA}}` or `--pr {{.PR.Number}}`.
+// Jobs of a matrix also get the values of their combination, which take
+// precedence over the fields of the event.
+func callData(event *GithubEvent, matrix map[string]string) map[string]any {
+	pr := CallPullRequest{}
+	if event.PullRequestEvent != nil {
+		pr.Number = event.PullRequestEvent.GetNumber()
+		pr.Title = event.PullRequestEvent.GetPullRequest().GetTitle()
+		pr.Author = event.PullRequestEvent.GetPullRequest().GetUser().GetLogin()
+	}
+
+	data := map[string]any{
+		"Event":      event.EventType,
+		"Repository": event.RepositoryName,
+		"Ref":        event.Ref,
+		"Branch":     event.Branch,
+		"SHA":        event.SHA,
+		"BaseBranch": event.BaseBranch,
+		"PR":         pr,
+	}
+	for key, value := range matrix {
+		data[key] = value
+	}
+	return data
+}
+
+// shellPlaceholders returns a copy of `data` whose strings are replaced by
+// placeholders, and the values they stand for. Calls are rendered with the
+// placeholders so `quotePlaceholders` can quote the values for the shell the
+// calls run in, and values controlled by whoever triggers the event, e.g. a
+// branch named `x;touch /pwned`, can't inject commands.
+func shellPlaceholders(data map[string]any) (map[string]any, []string) {
+	values := []string{}
+	placeholder := func(value string) string {
+		values = append(values, value)
+		return fmt.Sprintf("\x00%d\x00", len(values)-1)
+	}
+
+	replaced := map[string]any{}
+	for key, value := range data {
+		switch v := value.(type) {
+		case string:
+			replaced[key] = placeholder(v)
+		case CallPullRequest:
+			v.Title = placeholder(v.Title)
+			v.Author = placeholder(v.Author)
+			replaced[key] = v
+		default:
+			replaced[key] = value
+		}
+	}
+	return replaced, values
+}
+
+// quotePlaceholders replaces the placeholders of the rendered `call` by their
+// values, quoted for where they are: values outside of quotes are single
+// quoted, values inside double quotes have `"`, `$`, `\` and backticks escaped
+// and values inside single quotes have their single quotes escaped. Templates
+// can then quote values, e.g. `--title "{{.PR.Title}}"`, without changing how
+// they are passed.
+func quotePlaceholders(call string, values []string) string {
+	out := &strings.Builder{}
+	var quote byte
+	for i := 0; i < len(call); i++ {
+		c := call[i]
+		switch {
+		case c == 0:
+			end := strings.IndexByte(call[i+1:], 0)
+			if end < 0 {
+				break
+			}
+			n, err := strconv.Atoi(call[i+1 : i+1+end])
+			if err != nil || n >= len(values) {
+				break
+			}
+			out.WriteString(quoteValue(values[n], quote))
+			i += end + 1
+			continue
+		case c == '\\' && quote != '\'' && i+1 < len(call) && call[i+1] != 0:
+			// escaped characters don't open or close quotes
+			out.WriteByte(c)
+			i++
+			c = call[i]
+		case c == '\'' || c == '"':
+			if quote == 0 {
+				quote = c
+			} else if quote == c {
+				quote = 0
+			}
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// quoteValue quotes `value` for a call where it is inside of `quote`, or
+// outside of quotes when `quote` is 0.
+func quoteValue(value string, quote byte) string {
+	switch quote {
+	case '\'':
+		return strings.ReplaceAll(value, "'", `'\''`)
+	case '"':
+		return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`").Replace(value)
+	default:
+		return shellQuote(value)
+	}
+}
+
+// renderTemplate renders `text` with `data`. Referencing a key that is not
+// in the data is an error.
+func renderTemplate(text string, data map[string]any) (string, error) {
+	tmpl, err := template.New("call").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	out := &strings.Builder{}
+	if err := tmpl.Execute(out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// renderPipelines renders the calls, the environment variables and the
+// concurrency groups of the pipelines with the data of `event`, so what is
+// queued is exactly what runs. The values rendered into calls are quoted
+// since calls run through a shell.
+func renderPipelines(event *GithubEvent, pipelines []*Pipeline) error {
+	for _, p := range pipelines {
+		data := callData(event, p.MatrixValues)
+		placeholders, values := shellPlaceholders(data)
+
+		exec := []string{}
+		for _, e := range p.Exec {
+			call, err := renderTemplate(e, placeholders)
+			if err != nil {
+				return fmt.Errorf("pipeline %s: %w", p.Name, err)
+			}
+			exec = append(exec, quotePlaceholders(call, values))
+		}
+		p.Exec = exec
+
+		env := maps.Clone(p.Env)
+		for key, value := range p.Env {
+			rendered, err := renderTemplate(value, data)
+			if err != nil {
+				return fmt.Errorf("pipeline %s: env %s: %w", p.Name, key, err)
+			}
+			env[key] = rendered
+		}
+		p.Env = env
+
+		if p.Concurrency != nil {
+			concurrency := *p.Concurrency
+			group, err := renderTemplate(concurrency.Group, data)
+			if err != nil {
+				return fmt.Errorf("pipeline %s: concurrency group: %w", p.Name, err)
+			}
+			concurrency.Group = group
+			p.Concurrency = &concurrency
+		}
+	}
+	return nil
+}
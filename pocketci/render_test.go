@@ -0,0 +1,110 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRenderPipelines(t *testing.T) {
+	pr, err := parseGithubEvent(GithubPullRequest, ghPrOpen)
+	assert.NilError(t, err)
+	push, err := parseGithubEvent(GithubPush, ghCommitPush)
+	assert.NilError(t, err)
+
+	cases := []struct {
+		name        string
+		event       *GithubEvent
+		pipeline    *Pipeline
+		exec        []string
+		env         map[string]string
+		concurrency *ConcurrencyPolicy
+		err         string
+	}{
+		{
+			name:     "pull request",
+			event:    pr,
+			pipeline: &Pipeline{Name: "preview", Exec: []string{"deploy --pr {{.PR.Number}} --tag {{.SHA}}"}},
+			exec:     []string{"deploy --pr 1 --tag 'dfe65b129f357672552d6a28b0c711710a8f3750'"},
+		},
+		{
+			name:     "push",
+			event:    push,
+			pipeline: &Pipeline{Name: "publish", Exec: []string{"publish --branch {{.Branch}} --pr {{.PR.Number}}"}},
+			exec:     []string{"publish --branch 'main' --pr 0"},
+		},
+		{
+			name:  "env",
+			event: push,
+			pipeline: &Pipeline{Name: "publish", Exec: []string{"publish"}, Env: map[string]string{
+				"IMAGE_TAG": "{{.Branch}}-{{.SHA}}",
+				"REGISTRY":  "ghcr.io",
+			}},
+			exec: []string{"publish"},
+			env: map[string]string{
+				"IMAGE_TAG": "main-42c3996eddca0ebf02ad05fed546ff7902349ead",
+				"REGISTRY":  "ghcr.io",
+			},
+		},
+		{
+			name:  "concurrency group",
+			event: pr,
+			pipeline: &Pipeline{Name: "preview", Exec: []string{"deploy"},
+				Concurrency: &ConcurrencyPolicy{Group: "preview-{{.PR.Number}}", CancelInProgress: true}},
+			exec:        []string{"deploy"},
+			concurrency: &ConcurrencyPolicy{Group: "preview-1", CancelInProgress: true},
+		},
+		{
+			name:     "matrix values",
+			event:    push,
+			pipeline: &Pipeline{Name: "test", Exec: []string{"test --go {{.go}} --sha {{.SHA}}"}, MatrixValues: map[string]string{"go": "1.23"}},
+			exec:     []string{"test --go '1.23' --sha '42c3996eddca0ebf02ad05fed546ff7902349ead'"},
+		},
+		{
+			name:  "shell injection",
+			event: &GithubEvent{EventType: GithubPush, Branch: "x;touch /pwned", SHA: "it's"},
+			pipeline: &Pipeline{Name: "publish", Exec: []string{"publish --branch {{.Branch}} --sha {{.SHA}}"},
+				Env: map[string]string{"BRANCH": "{{.Branch}}"}},
+			exec: []string{`publish --branch 'x;touch /pwned' --sha 'it'\''s'`},
+			env:  map[string]string{"BRANCH": "x;touch /pwned"},
+		},
+		{
+			name:     "quoted template",
+			event:    pr,
+			pipeline: &Pipeline{Name: "preview", Exec: []string{`deploy --title "{{.PR.Title}}" --sha '{{.SHA}}'`}},
+			exec:     []string{`deploy --title "Branch used in the context of pocketci integration tests" --sha 'dfe65b129f357672552d6a28b0c711710a8f3750'`},
+		},
+		{
+			name:     "shell injection in quoted template",
+			event:    &GithubEvent{EventType: GithubPush, Branch: `x" $(touch /pwned) \`, SHA: "it's"},
+			pipeline: &Pipeline{Name: "publish", Exec: []string{`publish --branch "{{.Branch}}" --sha '{{.SHA}}' "$HOME"`}},
+			exec:     []string{`publish --branch "x\" \$(touch /pwned) \\" --sha 'it'\''s' "$HOME"`},
+		},
+		{
+			name:     "unknown field",
+			event:    push,
+			pipeline: &Pipeline{Name: "publish", Exec: []string{"publish --tag {{.Tag}}"}},
+			err:      `pipeline publish: template: call:1:16: executing "call" at <.Tag>: map has no entry for key "Tag"`,
+		},
+		{
+			name:     "unknown field in env",
+			event:    push,
+			pipeline: &Pipeline{Name: "publish", Exec: []string{"publish"}, Env: map[string]string{"TAG": "{{.Tag}}"}},
+			err:      `pipeline publish: env TAG: template: call:1:2: executing "call" at <.Tag>: map has no entry for key "Tag"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := renderPipelines(tc.event, []*Pipeline{tc.pipeline})
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, tc.pipeline.Exec, tc.exec)
+			assert.DeepEqual(t, tc.pipeline.Env, tc.env)
+			assert.DeepEqual(t, tc.pipeline.Concurrency, tc.concurrency)
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package pocketci
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Run is the record of how pocketci handled a single webhook. It is kept so
+// users can understand why pipelines did (or did not) run for a given event.
+type Run struct {
+	ID         int       `json:"id"`
+	Repository string    `json:"repository"`
+	EventType  string    `json:"event_type"`
+	GitInfo    GitInfo   `json:"git_info"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// SkipReason is set when the whole event was skipped before discovering
+	// any pipeline.
+	SkipReason       string            `json:"skip_reason,omitempty"`
+	SkippedPipelines []SkippedPipeline `json:"skipped_pipelines,omitempty"`
+	Pipelines        []string          `json:"pipelines"`
+	Error            string            `json:"error,omitempty"`
+
+	// Calls are the calls of each pipeline as they were queued, after
+	// rendering them with the event.
+	Calls map[string][]string `json:"calls,omitempty"`
+
+	// NeedsRerun is set when the run tested the merge of a pull request and
+	// its base branch moved afterwards.
+	NeedsRerun bool `json:"needs_rerun"`
+}
+
+// SkippedPipeline is a pipeline that was discovered but did not run.
+type SkippedPipeline struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// DefaultMaxRuns is the number of runs a `RunStore` keeps by default.
+const DefaultMaxRuns = 1000
+
+// RunStore keeps the most recent runs in memory.
+type RunStore struct {
+	// Max is the number of runs kept, creating a run drops the oldest one
+	// past it. Defaults to `DefaultMaxRuns`.
+	Max int
+
+	mu     sync.RWMutex
+	runs   map[int]*Run
+	lastID int
+}
+
+func NewRunStore() *RunStore {
+	return &RunStore{runs: map[int]*Run{}}
+}
+
+// Create stores the run assigning it a new ID.
+func (rs *RunStore) Create(run *Run) *Run {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.lastID++
+	run.ID = rs.lastID
+	run.CreatedAt = time.Now()
+	rs.runs[run.ID] = run
+
+	// IDs are sequential, so the run that falls out of the store is always
+	// the one created `max` runs ago
+	max := rs.Max
+	if max <= 0 {
+		max = DefaultMaxRuns
+	}
+	delete(rs.runs, run.ID-max)
+	return run
+}
+
+// Update calls `fn` with the run identified by `id` while holding the lock of
+// the store. It does nothing if the run does not exist.
+func (rs *RunStore) Update(id int, fn func(run *Run)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if run, ok := rs.runs[id]; ok {
+		fn(run)
+	}
+}
+
+// Get returns a copy of the run identified by `id`.
+func (rs *RunStore) Get(id int) (Run, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	run, ok := rs.runs[id]
+	if !ok {
+		return Run{}, false
+	}
+	return run.copy(), true
+}
+
+// List returns a copy of every run, most recent first.
+func (rs *RunStore) List() []Run {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	runs := make([]Run, 0, len(rs.runs))
+	for _, run := range rs.runs {
+		runs = append(runs, run.copy())
+	}
+	slices.SortFunc(runs, func(a, b Run) int { return b.ID - a.ID })
+	return runs
+}
+
+// MarkStale flags the runs that tested the merge of a pull request against
+// `branch` of `repository` at a commit other than `sha`.
+func (rs *RunStore) MarkStale(repository, branch, sha string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, run := range rs.runs {
+		if run.Repository == repository && run.GitInfo.staleMerge(branch, sha) {
+			run.NeedsRerun = true
+		}
+	}
+}
+
+func (r *Run) copy() Run {
+	c := *r
+	c.SkippedPipelines = slices.Clone(r.SkippedPipelines)
+	c.Pipelines = slices.Clone(r.Pipelines)
+	c.Calls = maps.Clone(r.Calls)
+	return c
+}
+
+func (s *Server) RunsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.orchestrator.Runs.List()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func (s *Server) RunHandler(w http.ResponseWriter, r *http.Request) {
+	runID, err := strconv.Atoi(r.PathValue("run_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	run, ok := s.orchestrator.Runs.Get(runID)
+	if !ok {
+		http.Error(w, "run not found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(run); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
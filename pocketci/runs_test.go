@@ -0,0 +1,25 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestRunStoreMax(t *testing.T) {
+	rs := NewRunStore()
+	rs.Max = 2
+
+	first := rs.Create(&Run{Repository: "franela/pocketci"})
+	rs.Create(&Run{Repository: "franela/pocketci"})
+	last := rs.Create(&Run{Repository: "franela/pocketci"})
+
+	_, ok := rs.Get(first.ID)
+	assert.Assert(t, !ok)
+
+	ids := []int{}
+	for _, run := range rs.List() {
+		ids = append(ids, run.ID)
+	}
+	assert.DeepEqual(t, ids, []int{last.ID, last.ID - 1})
+}
@@ -0,0 +1,248 @@
+package pocketci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SecretBackend is a source of the secrets of specs. The values it returns
+// are handed to the discovery function and to the agents, which turn them
+// into `dagger.Secret`s with `WithSecrets`.
+type SecretBackend interface {
+	// Lookup returns the value of the secret identified by `req`.
+	Lookup(ctx context.Context, req SecretRequest) (string, error)
+}
+
+// SecretRequest identifies a secret within a backend.
+type SecretRequest struct {
+	// Repository is the full name of the repository the secret is used for,
+	// e.g. `franela/pocketci`.
+	Repository string
+	// Ref is the reference of the secret in the backend: an environment
+	// variable, a file, a key of the store or a sops file of the repository.
+	Ref string
+	// Key is the dot separated path of the value within sops files.
+	Key string
+
+	mirror *Mirror
+	sha    string
+}
+
+// SecretBackends are the backends available to specs, one for each source of
+// `SecretSpec`. Secrets of a source without backend can't be resolved.
+type SecretBackends struct {
+	Env   SecretBackend
+	File  SecretBackend
+	Store SecretBackend
+	Sops  SecretBackend
+}
+
+// DefaultSecretBackends only reads secrets from the environment.
+func DefaultSecretBackends() *SecretBackends {
+	return &SecretBackends{Env: EnvSecrets{}}
+}
+
+// lookup returns the value of `secret` from the backend of its source.
+func (b *SecretBackends) lookup(ctx context.Context, req SecretRequest, secret SecretSpec) (string, error) {
+	if b == nil {
+		b = DefaultSecretBackends()
+	}
+
+	var backend SecretBackend
+	source := ""
+	switch {
+	case secret.FromEnv != "":
+		backend, source, req.Ref = b.Env, "from-env", secret.FromEnv
+	case secret.FromFile != "":
+		backend, source, req.Ref = b.File, "from-file", secret.FromFile
+	case secret.FromStore != "":
+		backend, source, req.Ref = b.Store, "from-store", secret.FromStore
+	case secret.FromSops != "":
+		backend, source, req.Ref, req.Key = b.Sops, "from-sops", secret.FromSops, secret.Key
+	}
+
+	if backend == nil {
+		return "", fmt.Errorf("%s secrets are not configured", source)
+	}
+	return backend.Lookup(ctx, req)
+}
+
+// EnvSecretPrefix is the prefix of the environment variables specs can always
+// read secrets from.
+const EnvSecretPrefix = "POCKETCI_SECRET_"
+
+// EnvSecrets reads secrets from the environment of pocketci. Specs can only
+// read the variables prefixed with `EnvSecretPrefix` or listed in `Allowed`,
+// so they can't read the credentials of pocketci itself.
+type EnvSecrets struct {
+	Allowed []string
+}
+
+func (e EnvSecrets) Lookup(ctx context.Context, req SecretRequest) (string, error) {
+	if !strings.HasPrefix(req.Ref, EnvSecretPrefix) && !slices.Contains(e.Allowed, req.Ref) {
+		return "", fmt.Errorf("environment variable %s is not allowed, secrets can only be read from variables prefixed with %s or allowed by the config", req.Ref, EnvSecretPrefix)
+	}
+
+	value, ok := os.LookupEnv(req.Ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", req.Ref)
+	}
+	return value, nil
+}
+
+// FileSecrets reads secrets from the files of a directory, e.g. Kubernetes
+// secrets mounted as a volume. A single trailing newline is removed.
+type FileSecrets struct {
+	Dir string
+}
+
+func (f *FileSecrets) Lookup(ctx context.Context, req SecretRequest) (string, error) {
+	if !filepath.IsLocal(req.Ref) {
+		return "", fmt.Errorf("invalid secret file %s", req.Ref)
+	}
+
+	contents, err := os.ReadFile(filepath.Join(f.Dir, req.Ref))
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %w", err)
+	}
+	return strings.TrimSuffix(string(contents), "\n"), nil
+}
+
+// HTTPSecretStore reads secrets from an HTTP service. Secrets are requested
+// with `GET <URL>/secrets/<ref>` and the repository that uses them in the
+// `X-Pocketci-Repository` header. The store responds with `{"value": "..."}`
+// or 404 when the secret doesn't exist.
+type HTTPSecretStore struct {
+	URL string
+	// Token is sent as a bearer token when set.
+	Token string
+}
+
+// SecretRepositoryHeader is the header with the repository that requests a
+// secret from an `HTTPSecretStore`.
+const SecretRepositoryHeader = "X-Pocketci-Repository"
+
+func (s *HTTPSecretStore) Lookup(ctx context.Context, req SecretRequest) (string, error) {
+	if !filepath.IsLocal(req.Ref) {
+		return "", fmt.Errorf("invalid secret %s", req.Ref)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(s.URL, "/")+"/secrets/"+req.Ref, nil)
+	if err != nil {
+		return "", err
+	}
+	if s.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	r.Header.Set(SecretRepositoryHeader, req.Repository)
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", fmt.Errorf("secret %s not found in the store", req.Ref)
+	default:
+		return "", fmt.Errorf("could not get secret %s from the store: unexpected status code %d", req.Ref, res.StatusCode)
+	}
+
+	secret := struct {
+		Value *string `json:"value"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid response of the store: %w", err)
+	}
+	if secret.Value == nil {
+		return "", fmt.Errorf("invalid response of the store: secret %s has no value", req.Ref)
+	}
+	return *secret.Value, nil
+}
+
+// SopsSecrets decrypts sops files committed to the repositories with a key
+// held by the server, e.g. an age key.
+type SopsSecrets struct {
+	// AgeKeyFile is the path of the age key used to decrypt the files.
+	AgeKeyFile string
+	// Command runs sops. Defaults to `sops`.
+	Command []string
+}
+
+func (s *SopsSecrets) Lookup(ctx context.Context, req SecretRequest) (string, error) {
+	if req.mirror == nil {
+		return "", errors.New("sops secrets need the repository")
+	}
+
+	contents, err := req.mirror.ReadFile(ctx, req.sha, req.Ref)
+	if err != nil {
+		return "", err
+	}
+
+	// sops detects the format of the file by its extension
+	f, err := os.CreateTemp("", "pocketci-sops-*"+path.Ext(req.Ref))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(contents); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	command := s.Command
+	if len(command) == 0 {
+		command = []string{"sops"}
+	}
+	args := append(command[1:len(command):len(command)], "--decrypt", "--output-type", "json", f.Name())
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, command[0], args...)
+	cmd.Env = os.Environ()
+	if s.AgeKeyFile != "" {
+		cmd.Env = append(cmd.Env, "SOPS_AGE_KEY_FILE="+s.AgeKeyFile)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %s: %s", req.Ref, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var value any
+	if err := json.Unmarshal(stdout.Bytes(), &value); err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %w", req.Ref, err)
+	}
+	for _, field := range strings.Split(req.Key, ".") {
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("key %s not found in %s", req.Key, req.Ref)
+		}
+		if value, ok = fields[field]; !ok {
+			return "", fmt.Errorf("key %s not found in %s", req.Key, req.Ref)
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("key %s of %s is not a scalar", req.Key, req.Ref)
+	}
+}
@@ -0,0 +1,144 @@
+package pocketci
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestFileSecrets(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0o600))
+
+	backend := &FileSecrets{Dir: dir}
+	value, err := backend.Lookup(ctx, SecretRequest{Ref: "token"})
+	assert.NilError(t, err)
+	assert.Equal(t, value, "secret")
+
+	_, err = backend.Lookup(ctx, SecretRequest{Ref: "../token"})
+	assert.Error(t, err, "invalid secret file ../token")
+}
+
+func TestHTTPSecretStore(t *testing.T) {
+	ctx := context.Background()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /secrets/{key...}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer store-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.PathValue("key") != "ci/api-key" || r.Header.Get(SecretRepositoryHeader) != "franela/pocketci" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"value": "secret"}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cases := []struct {
+		name     string
+		token    string
+		req      SecretRequest
+		expected string
+		err      string
+	}{
+		{
+			name:     "found",
+			token:    "store-token",
+			req:      SecretRequest{Repository: "franela/pocketci", Ref: "ci/api-key"},
+			expected: "secret",
+		},
+		{
+			name:  "other repository",
+			token: "store-token",
+			req:   SecretRequest{Repository: "franela/other", Ref: "ci/api-key"},
+			err:   "secret ci/api-key not found in the store",
+		},
+		{
+			name: "unauthorized",
+			req:  SecretRequest{Repository: "franela/pocketci", Ref: "ci/api-key"},
+			err:  "could not get secret ci/api-key from the store: unexpected status code 401",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &HTTPSecretStore{URL: server.URL, Token: tc.token}
+			value, err := store.Lookup(ctx, tc.req)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, value, tc.expected)
+		})
+	}
+}
+
+func TestSopsSecrets(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	sha := repo.commit(map[string]string{
+		"secrets.enc.json": `{"db": {"password": "secret", "port": 5432}}`,
+	})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	mirror, err := mirrors.Fetch(ctx, repo.url(), sha, "refs/heads/main")
+	assert.NilError(t, err)
+
+	// stands in for sops, the file is not encrypted
+	sops := filepath.Join(t.TempDir(), "sops")
+	assert.NilError(t, os.WriteFile(sops, []byte("#!/bin/sh\ntest \"$SOPS_AGE_KEY_FILE\" = age.key && cat \"$4\"\n"), 0o755))
+
+	backend := &SopsSecrets{AgeKeyFile: "age.key", Command: []string{sops}}
+	req := SecretRequest{Ref: "secrets.enc.json", mirror: mirror, sha: sha}
+
+	req.Key = "db.password"
+	value, err := backend.Lookup(ctx, req)
+	assert.NilError(t, err)
+	assert.Equal(t, value, "secret")
+
+	req.Key = "db.port"
+	value, err = backend.Lookup(ctx, req)
+	assert.NilError(t, err)
+	assert.Equal(t, value, "5432")
+
+	req.Key = "db.user"
+	_, err = backend.Lookup(ctx, req)
+	assert.Error(t, err, "key db.user not found in secrets.enc.json")
+
+	req.Key = "db"
+	_, err = backend.Lookup(ctx, req)
+	assert.Error(t, err, "key db of secrets.enc.json is not a scalar")
+}
+
+func TestSecretBackends(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("POCKETCI_SECRET_TEST_TOKEN", "secret")
+	t.Setenv("POCKETCI_TEST_TOKEN", "internal")
+
+	backends := DefaultSecretBackends()
+	value, err := backends.lookup(ctx, SecretRequest{}, SecretSpec{Name: "token", FromEnv: "POCKETCI_SECRET_TEST_TOKEN"})
+	assert.NilError(t, err)
+	assert.Equal(t, value, "secret")
+
+	// the rest of the environment has to be allowed explicitly
+	_, err = backends.lookup(ctx, SecretRequest{}, SecretSpec{Name: "token", FromEnv: "POCKETCI_TEST_TOKEN"})
+	assert.Error(t, err, "environment variable POCKETCI_TEST_TOKEN is not allowed, secrets can only be read from variables prefixed with POCKETCI_SECRET_ or allowed by the config")
+
+	backends.Env = EnvSecrets{Allowed: []string{"POCKETCI_TEST_TOKEN"}}
+	value, err = backends.lookup(ctx, SecretRequest{}, SecretSpec{Name: "token", FromEnv: "POCKETCI_TEST_TOKEN"})
+	assert.NilError(t, err)
+	assert.Equal(t, value, "internal")
+
+	_, err = backends.lookup(ctx, SecretRequest{}, SecretSpec{Name: "token", FromStore: "ci/token"})
+	assert.Error(t, err, "from-store secrets are not configured")
+}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"context"
 	"crypto/hmac"
-	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -17,37 +18,116 @@ import (
 	"dagger.io/dagger"
 )
 
-const GithubEventTypeHeader = "X-Github-Event"
+const (
+	GithubEventTypeHeader = "X-Github-Event"
+	GithubSignatureHeader = "X-Hub-Signature-256"
+)
 
 type Server struct {
 	orchestrator    *Orchestrator
+	snapshots       *Snapshots
 	githubSignature string
+	agentToken      string
 
 	mu sync.Mutex
 }
 
 // TODO: move away into a proper `Config` structure for the server
 type ServerOptions struct {
-	GithubUsername  string
-	GithubPassword  string
+	// GithubSignature is the secret GitHub signs the webhooks with. Webhooks
+	// that are not signed with it are rejected.
 	GithubSignature string
+
+	// AgentToken is the token agents authenticate with, see `AgentHandler`.
+	AgentToken string
+
+	// Credentials are used to fetch repositories. Repositories are fetched
+	// without credentials when nil.
+	Credentials CredentialProvider
+
+	// SkipToken is the pocketci specific directive that skips the pipelines of
+	// an event. Defaults to `DefaultSkipToken`.
+	SkipToken string
+
+	// MirrorsPath is the directory where repository mirrors are stored.
+	// Defaults to `DefaultMirrorsPath()`.
+	MirrorsPath string
+	// MirrorDepth is the history depth of new mirrors, see `Mirrors.Depth`.
+	MirrorDepth int
+	// MirrorBlobless makes mirrors partial clones, see `Mirrors.Blobless`.
+	MirrorBlobless bool
+
+	// SnapshotsPath is the directory where the snapshots served to agents
+	// are stored. Agents check out the repositories themselves when empty.
+	SnapshotsPath string
+
+	// Secrets are the backends of the secrets of specs. Defaults to
+	// `DefaultSecretBackends()`.
+	Secrets *SecretBackends
+
+	// Variables are injected into the pipelines of every event.
+	Variables *Variables
 }
 
 func NewServer(dag *dagger.Client, opts ServerOptions) (*Server, error) {
-	// warmup the container that will be used for each request
-	// TODO: Should git operations be handled outside of Dagger? Could that have
-	// a positive perf impact that is worth it?
+	if opts.GithubSignature == "" {
+		return nil, errors.New("github webhook secret is required")
+	}
+	if opts.AgentToken == "" {
+		return nil, errors.New("agent token is required")
+	}
+
+	// warmup the container that will be used for each request. Git operations
+	// happen on the host through the mirrors so they don't need a container.
 	if _, err := AgentContainer(dag).Sync(context.Background()); err != nil {
 		return nil, fmt.Errorf("warmup failed: %w", err)
 	}
 
+	mirrorsPath := opts.MirrorsPath
+	if mirrorsPath == "" {
+		mirrorsPath = DefaultMirrorsPath()
+	}
+	mirrors, err := NewMirrors(mirrorsPath, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	mirrors.Depth = opts.MirrorDepth
+	mirrors.Blobless = opts.MirrorBlobless
+
+	var snapshots *Snapshots
+	if opts.SnapshotsPath != "" {
+		if snapshots, err = NewSnapshots(opts.SnapshotsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	skipToken := opts.SkipToken
+	if skipToken == "" {
+		skipToken = DefaultSkipToken
+	}
+
 	s := &Server{
 		orchestrator: &Orchestrator{
-			Dispatcher:  NewLocalDispatcher(),
-			dag:         dag,
-			GithubNetrc: dag.SetSecret("github_auth", fmt.Sprintf("machine github.com login %s password %s", opts.GithubUsername, opts.GithubPassword)),
+			Dispatcher: NewLocalDispatcher(),
+			Runs:       NewRunStore(),
+			Mirrors:    mirrors,
+			Snapshots:  snapshots,
+			Secrets:    opts.Secrets,
+			Variables:  opts.Variables,
+			Includes:   NewSpecIncludes(mirrors),
+			dag:        dag,
+			SkipToken:  skipToken,
 		},
+		snapshots:       snapshots,
 		githubSignature: opts.GithubSignature,
+		agentToken:      opts.AgentToken,
+	}
+	go s.timeOutPipelines(context.Background())
+	if snapshots != nil {
+		ctx := context.Background()
+		go snapshots.PruneUnused(ctx, func() map[string]bool {
+			return s.orchestrator.Dispatcher.PendingSnapshots(ctx)
+		})
 	}
 
 	return s, nil
@@ -57,18 +137,7 @@ func NewServer(dag *dagger.Client, opts ServerOptions) (*Server, error) {
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch {
 	// Github webhook
-	case r.Header.Get("X-Hub-Signature") != "":
-		sig := r.Header.Get("X-Hub-Signature")
-		if sig == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		if err := validateGithubSignature(sig, s.githubSignature); err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-
+	case r.Header.Get(GithubEventTypeHeader) != "":
 		b, err := io.ReadAll(r.Body)
 		if err != nil {
 			slog.Debug("failed to get request body", slog.String("error", err.Error()))
@@ -77,6 +146,13 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		r.Body = io.NopCloser(bytes.NewBuffer(b))
 
+		// the payload decides which secrets are resolved and handed to
+		// pipelines, so it must come from GitHub
+		if err := validateGithubSignature(r.Header.Get(GithubSignatureHeader), b, s.githubSignature); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
 		go func() {
 			wh := &Webhook{
 				Vendor:    GithubVendor,
@@ -94,21 +170,26 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func validateGithubSignature(signature string, secret string) error {
-	signature = strings.TrimPrefix(signature, "sha1=")
-
-	mac := hmac.New(sha1.New, []byte(secret))
+// validateGithubSignature checks that `signature`, the value of the
+// `X-Hub-Signature-256` header, is the HMAC-SHA256 of `body` with `secret`.
+func validateGithubSignature(signature string, body []byte, secret string) error {
+	if secret == "" {
+		return errors.New("no webhook secret configured")
+	}
 
-	_, err := mac.Write([]byte(signature))
+	sig, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return errors.New("missing sha256 signature")
+	}
+	expected, err := hex.DecodeString(sig)
 	if err != nil {
-		return err
+		return errors.New("invalid signature")
 	}
 
-	actualMAC := hex.EncodeToString(mac.Sum(nil))
-
-	if hmac.Equal([]byte(signature), []byte(actualMAC)) {
-		return err
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(expected, mac.Sum(nil)) {
+		return errors.New("invalid signature")
 	}
-
 	return nil
 }
@@ -0,0 +1,78 @@
+package pocketci
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestValidateGithubSignature(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	sign := func(secret string, body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	cases := []struct {
+		name      string
+		signature string
+		body      []byte
+		secret    string
+		err       string
+	}{
+		{
+			name:      "valid",
+			signature: sign("webhook-secret", body),
+			body:      body,
+			secret:    "webhook-secret",
+		},
+		{
+			name:      "other secret",
+			signature: sign("other-secret", body),
+			body:      body,
+			secret:    "webhook-secret",
+			err:       "invalid signature",
+		},
+		{
+			name:      "tampered body",
+			signature: sign("webhook-secret", body),
+			body:      []byte(`{"action":"closed"}`),
+			secret:    "webhook-secret",
+			err:       "invalid signature",
+		},
+		{
+			name:   "missing signature",
+			body:   body,
+			secret: "webhook-secret",
+			err:    "missing sha256 signature",
+		},
+		{
+			name:      "not hex",
+			signature: "sha256=not-hex",
+			body:      body,
+			secret:    "webhook-secret",
+			err:       "invalid signature",
+		},
+		{
+			name:      "no secret",
+			signature: sign("", body),
+			body:      body,
+			err:       "no webhook secret configured",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateGithubSignature(tc.signature, tc.body, tc.secret)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+		})
+	}
+}
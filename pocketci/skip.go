@@ -0,0 +1,40 @@
+package pocketci
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultSkipToken is the pocketci specific directive that, just like `[skip ci]`,
+// prevents an event from triggering any pipeline.
+const DefaultSkipToken = "[skip pocketci]"
+
+// ciSkipTokens are the directives most CI systems honor to skip a run.
+var ciSkipTokens = []string{"[skip ci]", "[ci skip]"}
+
+// skipDirective returns the directive found in `message` that should cause the
+// whole event to be skipped. `tokens` are checked on top of the well known
+// `[skip ci]` and `[ci skip]` directives. Matching is case insensitive. An
+// empty string is returned if the event should not be skipped.
+func skipDirective(message string, tokens ...string) string {
+	message = strings.ToLower(message)
+	for _, token := range append(ciSkipTokens, tokens...) {
+		if token == "" {
+			continue
+		}
+		if strings.Contains(message, strings.ToLower(token)) {
+			return token
+		}
+	}
+	return ""
+}
+
+// pipelineSkipDirective returns the `[skip <pipeline>]` directive if it is
+// present in `message`, otherwise it returns an empty string.
+func pipelineSkipDirective(message, pipeline string) string {
+	token := fmt.Sprintf("[skip %s]", pipeline)
+	if strings.Contains(strings.ToLower(message), strings.ToLower(token)) {
+		return token
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSkipDirective(t *testing.T) {
+	cases := []struct {
+		name      string
+		message   string
+		tokens    []string
+		directive string
+	}{
+		{
+			name:    "no directive",
+			message: "fix flaky test",
+		},
+		{
+			name:      "skip ci",
+			message:   "update README [skip ci]",
+			directive: "[skip ci]",
+		},
+		{
+			name:      "ci skip in the body",
+			message:   "update README\n\n[CI SKIP]",
+			directive: "[ci skip]",
+		},
+		{
+			name:      "custom token",
+			message:   "update README [skip pocketci]",
+			tokens:    []string{DefaultSkipToken},
+			directive: DefaultSkipToken,
+		},
+		{
+			name:    "custom token is not configured",
+			message: "update README [skip pocketci]",
+		},
+		{
+			name:    "empty tokens are ignored",
+			message: "update README",
+			tokens:  []string{""},
+		},
+	}
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, skipDirective(test.message, test.tokens...), test.directive)
+		})
+	}
+}
+
+func TestPipelineSkipDirective(t *testing.T) {
+	assert.Equal(t, pipelineSkipDirective("bump deps [skip e2e]", "e2e"), "[skip e2e]")
+	assert.Equal(t, pipelineSkipDirective("bump deps [Skip E2E]", "e2e"), "[skip e2e]")
+	assert.Equal(t, pipelineSkipDirective("bump deps [skip e2e]", "unit"), "")
+}
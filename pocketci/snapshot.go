@@ -0,0 +1,408 @@
+package pocketci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Snapshots is a content-addressed store of tarballs with the trees checked
+// out for pipelines. The server exports them so agents don't need access to
+// the repositories, agents keep them as a cache. The server prunes the
+// snapshots no pending pipeline references and agents the ones none of their
+// pipelines is running with, see `PruneUnused`.
+type Snapshots struct {
+	root string
+
+	// Client downloads snapshots from the server. Defaults to
+	// `http.DefaultClient`.
+	Client *http.Client
+}
+
+// SnapshotGrace is how long a snapshot is kept after it was created even if
+// no pipeline references it, so the ones being dispatched are not pruned.
+const SnapshotGrace = 10 * time.Minute
+
+// snapshotPruneInterval is how often snapshots are pruned.
+const snapshotPruneInterval = 10 * time.Minute
+
+// digestPrefix is the algorithm of the digests that identify snapshots.
+const digestPrefix = "sha256:"
+
+// DefaultSnapshotsPath returns the directory used to store snapshots when none
+// is configured.
+func DefaultSnapshotsPath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "pocketci", "snapshots")
+}
+
+func NewSnapshots(root string) (*Snapshots, error) {
+	if err := os.MkdirAll(filepath.Join(root, "extracted"), 0o755); err != nil {
+		return nil, fmt.Errorf("could not create snapshots directory: %w", err)
+	}
+	return &Snapshots{root: root}, nil
+}
+
+// Create stores the contents of `dir`, except for `.git` entries, and returns
+// the digest of the snapshot. The same contents always produce the same
+// digest.
+func (s *Snapshots) Create(dir string) (string, error) {
+	f, err := os.CreateTemp(s.root, "snapshot-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if err := writeSnapshot(io.MultiWriter(f, hash), dir); err != nil {
+		return "", fmt.Errorf("could not create snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	digest := digestPrefix + hex.EncodeToString(hash.Sum(nil))
+	path, _ := s.path(digest)
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// Open returns the tarball of the snapshot identified by `digest`.
+func (s *Snapshots) Open(digest string) (*os.File, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Fetch downloads the snapshot identified by `digest` from the server at
+// `serverURL` unless it is already in the store, and returns the directory
+// where it is extracted.
+func (s *Snapshots) Fetch(ctx context.Context, serverURL, digest string) (string, error) {
+	path, err := s.path(digest)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(s.root, "extracted", strings.TrimPrefix(digest, digestPrefix))
+	if _, err := os.Stat(dir); err != nil {
+		if err := s.extract(ctx, serverURL, digest, path, dir); err != nil {
+			return "", err
+		}
+	}
+
+	// fetched snapshots are kept for a grace period, see `Prune`
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// extract extracts the snapshot at `path` into `dir`, downloading it first if
+// it is not in the store.
+func (s *Snapshots) extract(ctx context.Context, serverURL, digest, path, dir string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := s.download(ctx, serverURL, digest, path); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Join(s.root, "extracted"), "extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := extractSnapshot(f, tmp); err != nil {
+		return fmt.Errorf("could not extract snapshot %s: %w", digest, err)
+	}
+
+	// another pipeline might have extracted the same snapshot meanwhile
+	if err := os.Rename(tmp, dir); err != nil {
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Snapshots) download(ctx context.Context, serverURL, digest, path string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serverURL+"/snapshots/"+digest, nil)
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not download snapshot %s: unexpected status code %d", digest, res.StatusCode)
+	}
+
+	f, err := os.CreateTemp(s.root, "download-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), res.Body); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if actual := digestPrefix + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("snapshot %s does not match its digest, got %s", digest, actual)
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Prune removes the snapshots that are not in `keep` and were neither created
+// nor fetched since `before`, together with their extracted trees, and
+// returns their digests.
+func (s *Snapshots) Prune(keep map[string]bool, before time.Time) ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		return nil, err
+	}
+
+	pruned := []string{}
+	for _, entry := range entries {
+		sum, ok := strings.CutSuffix(entry.Name(), ".tar.gz")
+		if !ok || entry.IsDir() || keep[digestPrefix+sum] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return pruned, err
+		}
+		if !info.ModTime().Before(before) {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(s.root, "extracted", sum)); err != nil {
+			return pruned, err
+		}
+		if err := os.Remove(filepath.Join(s.root, entry.Name())); err != nil {
+			return pruned, err
+		}
+		pruned = append(pruned, digestPrefix+sum)
+	}
+	return pruned, nil
+}
+
+func (s *Snapshots) path(digest string) (string, error) {
+	sum, ok := strings.CutPrefix(digest, digestPrefix)
+	if !ok || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid snapshot digest %s", digest)
+	}
+	if _, err := hex.DecodeString(sum); err != nil {
+		return "", fmt.Errorf("invalid snapshot digest %s", digest)
+	}
+	return filepath.Join(s.root, sum+".tar.gz"), nil
+}
+
+// writeSnapshot writes the contents of `dir` as a gzipped tarball. Entries are
+// written in lexical order without timestamps nor owners so the output only
+// depends on the contents.
+func writeSnapshot(w io.Writer, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		if d.Name() == ".git" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		header.Uid, header.Gid = 0, 0
+		header.Uname, header.Gname = "", ""
+		header.ModTime = time.Unix(0, 0)
+		header.AccessTime, header.ChangeTime = time.Time{}, time.Time{}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// extractSnapshot extracts the gzipped tarball read from `r` into `dir`.
+func extractSnapshot(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("invalid path %s", header.Name)
+		}
+		path := filepath.Join(dir, header.Name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, header.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry %s of type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+func (s *Server) SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if s.snapshots == nil {
+		http.Error(w, "snapshots are disabled", http.StatusNotFound)
+		return
+	}
+
+	f, err := s.snapshots.Open(r.PathValue("digest"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "snapshot not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	if _, err := io.Copy(w, f); err != nil {
+		slog.Error("could not send snapshot", slog.String("error", err.Error()))
+	}
+}
+
+// PruneUnused periodically prunes the snapshots that are not returned by
+// `keep` and were not used within `SnapshotGrace`, until `ctx` is done.
+func (s *Snapshots) PruneUnused(ctx context.Context, keep func() map[string]bool) {
+	ticker := time.NewTicker(snapshotPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			pruned, err := s.Prune(keep(), now.Add(-SnapshotGrace))
+			if err != nil {
+				slog.Error("could not prune snapshots", slog.String("error", err.Error()))
+			}
+			for _, digest := range pruned {
+				slog.Info("pruned snapshot", slog.String("snapshot", digest))
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package pocketci
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	for path, contents := range map[string]string{
+		"main.go":        "package main",
+		"ci/dagger.json": "{}",
+		".git":           "gitdir: /mirrors/worktrees/checkout",
+	} {
+		assert.NilError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0o755))
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, path), []byte(contents), 0o644))
+	}
+	assert.NilError(t, os.Symlink("main.go", filepath.Join(dir, "link.go")))
+
+	snapshots, err := NewSnapshots(t.TempDir())
+	assert.NilError(t, err)
+
+	digest, err := snapshots.Create(dir)
+	assert.NilError(t, err)
+
+	// the digest only depends on the contents
+	assert.NilError(t, os.Chtimes(filepath.Join(dir, "main.go"), time.Unix(42, 0), time.Unix(42, 0)))
+	again, err := snapshots.Create(dir)
+	assert.NilError(t, err)
+	assert.Equal(t, again, digest)
+
+	mux := http.NewServeMux()
+	srv := &Server{snapshots: snapshots, agentToken: "agent-token"}
+	mux.HandleFunc("GET /snapshots/{digest}", srv.AgentHandler(srv.SnapshotHandler))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cache, err := NewSnapshots(t.TempDir())
+	assert.NilError(t, err)
+
+	// snapshots are only served to agents
+	_, err = cache.Fetch(ctx, server.URL, digest)
+	assert.ErrorContains(t, err, "unexpected status code 401")
+
+	cache.Client = &http.Client{Transport: &AgentTransport{Token: "agent-token"}}
+	extracted, err := cache.Fetch(ctx, server.URL, digest)
+	assert.NilError(t, err)
+
+	contents, err := os.ReadFile(filepath.Join(extracted, "ci", "dagger.json"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(contents), "{}")
+
+	link, err := os.Readlink(filepath.Join(extracted, "link.go"))
+	assert.NilError(t, err)
+	assert.Equal(t, link, "main.go")
+
+	_, err = os.Stat(filepath.Join(extracted, ".git"))
+	assert.Assert(t, os.IsNotExist(err))
+
+	// snapshots that were already fetched are not downloaded again
+	server.Close()
+	cached, err := cache.Fetch(ctx, server.URL, digest)
+	assert.NilError(t, err)
+	assert.Equal(t, cached, extracted)
+
+	// fetching a snapshot keeps it in the cache of the agent for a grace period
+	path, _ := cache.path(digest)
+	assert.NilError(t, os.Chtimes(path, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour)))
+	_, err = cache.Fetch(ctx, server.URL, digest)
+	assert.NilError(t, err)
+
+	pruned, err := cache.Prune(nil, time.Now().Add(-SnapshotGrace))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pruned, []string{})
+
+	pruned, err = cache.Prune(nil, time.Now().Add(time.Minute))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pruned, []string{digest})
+	_, err = os.Stat(extracted)
+	assert.Assert(t, os.IsNotExist(err))
+
+	_, err = cache.Fetch(ctx, server.URL, "sha256:../../etc/passwd")
+	assert.ErrorContains(t, err, "invalid snapshot digest")
+}
+
+func TestSnapshotsPrune(t *testing.T) {
+	ctx := context.Background()
+	snapshots, err := NewSnapshots(t.TempDir())
+	assert.NilError(t, err)
+
+	digests := map[string]string{}
+	for _, name := range []string{"pending", "done", "new"} {
+		dir := t.TempDir()
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte("package "+name), 0o644))
+		digests[name], err = snapshots.Create(dir)
+		assert.NilError(t, err)
+	}
+
+	ld := NewLocalDispatcher()
+	err = ld.Dispatch(ctx, GitInfo{}, []*Pipeline{
+		{Name: "pending", Exec: []string{"test"}, Snapshot: digests["pending"]},
+		{Name: "done", Exec: []string{"test"}, Snapshot: digests["done"]},
+	})
+	assert.NilError(t, err)
+
+	// the first pipeline is still running while the second one is done
+	assert.Equal(t, ld.GetPipeline(ctx, "").Name, "pending")
+	done := ld.GetPipeline(ctx, "")
+	assert.NilError(t, ld.PipelineDone(ctx, done.ID, done.Attempt, PipelineSucceeded, ""))
+
+	now := time.Now()
+	for _, name := range []string{"pending", "done"} {
+		path, _ := snapshots.path(digests[name])
+		assert.NilError(t, os.Chtimes(path, now.Add(-time.Hour), now.Add(-time.Hour)))
+	}
+
+	pruned, err := snapshots.Prune(ld.PendingSnapshots(ctx), now.Add(-SnapshotGrace))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pruned, []string{digests["done"]})
+
+	for name, digest := range digests {
+		_, err := snapshots.Open(digest)
+		assert.Equal(t, os.IsNotExist(err), name == "done", name)
+	}
+}
@@ -0,0 +1,419 @@
+package pocketci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/iancoleman/strcase"
+	"gopkg.in/yaml.v3"
+)
+
+// SpecFile is the file that configures pocketci for a repository.
+const SpecFile = "pocketci.yaml"
+
+// SpecVersion is the latest version of the spec. Specs that don't declare a
+// version are assumed to be of the latest one.
+const SpecVersion = 1
+
+// Spec is the pocketci configuration of a repository.
+type Spec struct {
+	Version    int    `yaml:"version"`
+	ModulePath string `yaml:"module-path"`
+	// Paths are globs of the files that, when changed, trigger the discovery
+	// of pipelines. Every change triggers it when empty.
+	Paths    []string     `yaml:"paths"`
+	Secrets  []SecretSpec `yaml:"secrets"`
+	Checkout SpecCheckout `yaml:"checkout"`
+	// Specs are globs of other spec files of the repository, each with its
+	// own module, paths and secrets. Only the root spec can declare them.
+	Specs []string `yaml:"specs"`
+	// Include is a spec of another repository this one is merged with, see
+	// `SpecIncludes`.
+	Include *SpecInclude `yaml:"include"`
+
+	// file is the path of the spec in the repository.
+	file string
+}
+
+// SpecCheckout are the checkout options of a spec, see `CheckoutOptions`.
+// Options that are not set are disabled unless the included spec enables them.
+type SpecCheckout struct {
+	Submodules *bool `yaml:"submodules"`
+	LFS        *bool `yaml:"lfs"`
+	MergeRef   *bool `yaml:"merge-ref"`
+	Sparse     *bool `yaml:"sparse"`
+}
+
+// Options returns the checkout options, with the ones that are not set
+// disabled.
+func (c SpecCheckout) Options() CheckoutOptions {
+	enabled := func(v *bool) bool { return v != nil && *v }
+	return CheckoutOptions{
+		Submodules: enabled(c.Submodules),
+		LFS:        enabled(c.LFS),
+		MergeRef:   enabled(c.MergeRef),
+		Sparse:     enabled(c.Sparse),
+	}
+}
+
+// SpecInclude is a spec of another repository at a pinned ref.
+type SpecInclude struct {
+	// Repository is the full name of a GitHub repository, e.g.
+	// `franela/ci-templates`, or the URL of any other git repository.
+	Repository string `yaml:"repository"`
+	// Ref is the commit or the tag the spec is read from.
+	Ref string `yaml:"ref"`
+	// File is the path of the spec in the repository. Defaults to
+	// `pocketci.yaml`.
+	File string `yaml:"file"`
+}
+
+// SecretSpec maps a secret of the pocketci environment to the calls. Exactly
+// one of the sources, `FromEnv`, `FromFile`, `FromStore` or `FromSops`, has to
+// be set, see `SecretBackends`.
+type SecretSpec struct {
+	// Name of the argument the secret is passed as. Calls can also reference
+	// it as `env:<NAME>`, see `SecretEnv`.
+	Name    string `yaml:"name"`
+	FromEnv string `yaml:"from-env"`
+	// FromFile is the path of the secret relative to the secret files
+	// directory of the server.
+	FromFile string `yaml:"from-file"`
+	// FromStore is the key of the secret in the HTTP secret store.
+	FromStore string `yaml:"from-store"`
+	// FromSops is the path of a sops encrypted file of the repository, and
+	// `Key` the dot separated path of the secret within it.
+	FromSops string `yaml:"from-sops"`
+	Key      string `yaml:"key"`
+	// Branches are globs of the branches whose pipelines can use the secret,
+	// any branch when empty.
+	Branches []string `yaml:"branches"`
+	// Events are the events whose pipelines can use the secret, `push` or
+	// `pull_request`. Any event when empty.
+	Events []string `yaml:"events"`
+
+	// source is the repository `FromSops` is read from when the secret comes
+	// from an included spec, the one of the event otherwise.
+	source *secretSource
+}
+
+type secretSource struct {
+	mirror *Mirror
+	sha    string
+}
+
+// allowed reports whether the pipelines of `event` can use the secret. Pull
+// requests are matched by their base branch, as whoever opens one picks the
+// name of its head branch, and pull requests from forks can't use any secret.
+func (s SecretSpec) allowed(event *GithubEvent) bool {
+	if event.fromFork() {
+		return false
+	}
+	if len(s.Events) > 0 && !slices.Contains(s.Events, event.EventType) {
+		return false
+	}
+	return len(s.Branches) == 0 || Match([]string{event.secretsBranch()}, s.Branches...)
+}
+
+// parseSpec parses and validates the contents of the spec at `file`, setting
+// the defaults of every field that is not specified. Unknown fields are
+// reported as errors. A root spec that lists other specs without a module
+// only indexes them and gets no `ModulePath`. Specs that include another one
+// are completed once they are merged with it, see `SpecIncludes`.
+func parseSpec(file string, contents []byte) (*Spec, error) {
+	spec := &Spec{file: file}
+	decoder := yaml.NewDecoder(bytes.NewReader(contents))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid %s: %w", file, err)
+	}
+
+	if spec.Include != nil {
+		if spec.Include.Repository == "" || spec.Include.Ref == "" {
+			return nil, fmt.Errorf("invalid %s: include needs a repository and a ref", file)
+		}
+		return spec, nil
+	}
+
+	if err := spec.complete(); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// complete sets the defaults of the spec and validates it.
+func (s *Spec) complete() error {
+	if s.Version == 0 {
+		s.Version = SpecVersion
+	}
+	if s.ModulePath == "" && len(s.Specs) == 0 {
+		s.ModulePath = "."
+	}
+
+	if err := s.validate(); err != nil {
+		return fmt.Errorf("invalid %s: %w", s.file, err)
+	}
+	return nil
+}
+
+// nest makes the module and paths of a spec listed by the root one relative
+// to its directory. It triggers on any change within its directory when it
+// doesn't declare paths.
+func (s *Spec) nest() error {
+	switch {
+	case len(s.Specs) > 0:
+		return fmt.Errorf("invalid %s: only %s can list other specs", s.file, SpecFile)
+	case s.Checkout != SpecCheckout{}:
+		return fmt.Errorf("invalid %s: checkout options can only be set in %s", s.file, SpecFile)
+	}
+
+	dir := path.Dir(s.file)
+	s.ModulePath = path.Join(dir, s.ModulePath)
+	if len(s.Paths) == 0 {
+		s.Paths = []string{"**"}
+	}
+	for i, p := range s.Paths {
+		s.Paths[i] = path.Join(dir, p)
+	}
+	for i, secret := range s.Secrets {
+		if secret.FromSops != "" && secret.source == nil {
+			s.Secrets[i].FromSops = path.Join(dir, secret.FromSops)
+		}
+	}
+	return nil
+}
+
+func (s *Spec) validate() error {
+	if s.Version != SpecVersion {
+		return fmt.Errorf("unsupported version %d, the latest version is %d", s.Version, SpecVersion)
+	}
+
+	for _, p := range s.Paths {
+		if err := validatePattern(p); err != nil {
+			return fmt.Errorf("invalid paths: %w", err)
+		}
+	}
+
+	for _, p := range s.Specs {
+		if err := validatePattern(p); err != nil {
+			return fmt.Errorf("invalid specs: %w", err)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, secret := range s.Secrets {
+		sources := 0
+		for _, source := range []string{secret.FromEnv, secret.FromFile, secret.FromStore, secret.FromSops} {
+			if source != "" {
+				sources++
+			}
+		}
+
+		switch {
+		case secret.Name == "":
+			return fmt.Errorf("secret %d is missing its name", i)
+		case sources != 1:
+			return fmt.Errorf("secret %s must set exactly one of from-env, from-file, from-store or from-sops", secret.Name)
+		case (secret.FromSops != "") != (secret.Key != ""):
+			return fmt.Errorf("secret %s must set key along from-sops", secret.Name)
+		case names[secret.Name]:
+			return fmt.Errorf("secret %s is defined more than once", secret.Name)
+		}
+		names[secret.Name] = true
+
+		for _, event := range secret.Events {
+			if event != GithubPush && event != GithubPullRequest {
+				return fmt.Errorf("secret %s: unsupported event %s", secret.Name, event)
+			}
+		}
+		for _, branch := range secret.Branches {
+			if err := validatePattern(branch); err != nil {
+				return fmt.Errorf("secret %s: invalid branches: %w", secret.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchPaths reports whether `changes` trigger the discovery of pipelines.
+func (s *Spec) matchPaths(changes []Change) bool {
+	return len(s.Paths) == 0 || Match(changedPaths(changes), s.Paths...)
+}
+
+// resolveSecrets returns the value of each secret of the spec by name, looked
+// up from `backends` for the repository of `event`.
+func (s *Spec) resolveSecrets(ctx context.Context, backends *SecretBackends, event *GithubEvent) (map[string]string, error) {
+	secrets := map[string]string{}
+	for _, secret := range s.Secrets {
+		req := SecretRequest{Repository: event.RepositoryName, mirror: event.mirror, sha: event.SHA}
+		if secret.source != nil {
+			req.mirror, req.sha = secret.source.mirror, secret.source.sha
+		}
+		value, err := backends.lookup(ctx, req, secret)
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %w", secret.Name, err)
+		}
+		secrets[secret.Name] = value
+	}
+	return secrets, nil
+}
+
+// allowedSecrets returns the `secrets` of the spec that `event` can use.
+func (s *Spec) allowedSecrets(event *GithubEvent, secrets map[string]string) map[string]string {
+	allowed := map[string]string{}
+	for _, secret := range s.Secrets {
+		if value, ok := secrets[secret.Name]; ok && secret.allowed(event) {
+			allowed[secret.Name] = value
+		}
+	}
+	return allowed
+}
+
+// secretArgs returns the flags that pass the `secrets` of the spec to a
+// function with the arguments `args`.
+func (s *Spec) secretArgs(args []string, secrets map[string]string) []string {
+	flags := []string{}
+	for _, secret := range s.Secrets {
+		if _, ok := secrets[secret.Name]; !ok {
+			continue
+		}
+		for _, arg := range args {
+			if arg == secret.Name {
+				flags = append(flags, "--"+strcase.ToKebab(secret.Name), "env:"+SecretEnv(secret.Name))
+			}
+		}
+	}
+	return flags
+}
+
+// scopeSecrets returns the secrets the pipeline declares. It fails when the
+// pipeline declares a secret the spec doesn't define, or when its calls
+// reference a secret of the spec it doesn't declare.
+func (s *Spec) scopeSecrets(p *Pipeline, secrets map[string]string) (map[string]string, error) {
+	scoped := map[string]string{}
+	for _, name := range p.Secrets {
+		value, ok := secrets[name]
+		if !ok {
+			return nil, fmt.Errorf("pipeline %s declares secret %s which is not defined in %s", p.Name, name, s.file)
+		}
+		scoped[name] = value
+	}
+
+	for _, secret := range s.Secrets {
+		if slices.Contains(p.Secrets, secret.Name) {
+			continue
+		}
+		ref := "env:" + SecretEnv(secret.Name)
+		for _, exec := range p.Exec {
+			if strings.Contains(exec, ref) {
+				return nil, fmt.Errorf("pipeline %s references secret %s (%s) without declaring it", p.Name, secret.Name, ref)
+			}
+		}
+	}
+	return scoped, nil
+}
+
+// deniedSecret returns the first secret declared by the pipeline that its
+// spec doesn't allow for `event`.
+func (s *Spec) deniedSecret(event *GithubEvent, p *Pipeline) (string, bool) {
+	for _, secret := range s.Secrets {
+		if slices.Contains(p.Secrets, secret.Name) && !secret.allowed(event) {
+			return secret.Name, true
+		}
+	}
+	return "", false
+}
+
+// SecretEnv returns the environment variable a secret is exposed as, the name
+// of the secret in SCREAMING_SNAKE_CASE, e.g. `GH_USERNAME` for `ghUsername`.
+func SecretEnv(name string) string {
+	return strcase.ToScreamingSnake(name)
+}
+
+// discoveryPaths returns the paths checked out to discover the pipelines of
+// `specs`: the spec files and their modules. The whole repository is checked
+// out when nil is returned.
+func discoveryPaths(checkout CheckoutOptions, specs []*Spec) []string {
+	if !checkout.Sparse {
+		return nil
+	}
+
+	paths := []string{SpecFile}
+	for _, spec := range specs {
+		if path.Clean(spec.ModulePath) == "." {
+			return nil
+		}
+		if spec.file != SpecFile {
+			paths = append(paths, spec.file)
+		}
+		paths = append(paths, spec.ModulePath)
+	}
+	return paths
+}
+
+// readSpec reads the spec at `file` of the repository at `sha`, merged with
+// the spec it includes. Repositories without a spec get the default one.
+func readSpec(ctx context.Context, mirror *Mirror, sha, file string, includes *SpecIncludes) (*Spec, error) {
+	contents, err := mirror.ReadFile(ctx, sha, file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	spec, err := parseSpec(file, contents)
+	if err != nil {
+		return nil, err
+	}
+	if err := includes.resolve(ctx, spec); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// readSpecs returns the specs of the repository at `sha`: the root one, unless
+// it only lists other specs, followed by every spec it lists.
+func readSpecs(ctx context.Context, mirror *Mirror, sha string, root *Spec, includes *SpecIncludes) ([]*Spec, error) {
+	if len(root.Specs) == 0 {
+		return collectSpecs(root, nil, nil)
+	}
+
+	files, err := mirror.Files(ctx, sha)
+	if err != nil {
+		return nil, err
+	}
+	return collectSpecs(root, files, func(file string) (*Spec, error) {
+		return readSpec(ctx, mirror, sha, file, includes)
+	})
+}
+
+// collectSpecs returns `root`, unless it only lists other specs, followed by
+// the specs of `files` it lists, which are loaded with `load`.
+func collectSpecs(root *Spec, files []string, load func(file string) (*Spec, error)) ([]*Spec, error) {
+	specs := []*Spec{}
+	if root.ModulePath != "" {
+		specs = append(specs, root)
+	}
+
+	for _, file := range files {
+		if file == SpecFile || len(root.Specs) == 0 || !Match([]string{file}, root.Specs...) {
+			continue
+		}
+
+		spec, err := load(file)
+		if err != nil {
+			return nil, err
+		}
+		if err := spec.nest(); err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
@@ -0,0 +1,337 @@
+package pocketci
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-github/v61/github"
+	"gotest.tools/v3/assert"
+)
+
+// cmpSpec compares specs including the file they were read from.
+var cmpSpec = cmp.AllowUnexported(Spec{}, SecretSpec{})
+
+func TestParseSpec(t *testing.T) {
+	cases := []struct {
+		name     string
+		contents string
+		expected *Spec
+		err      string
+	}{
+		{
+			name:     "empty",
+			contents: "",
+			expected: &Spec{Version: 1, ModulePath: ".", file: SpecFile},
+		},
+		{
+			name: "full",
+			contents: `
+version: 1
+module-path: ./ci
+paths:
+  - "**/**.go"
+secrets:
+  - name: ghUsername
+    from-env: GITHUB_USERNAME
+checkout:
+  submodules: true
+`,
+			expected: &Spec{
+				Version:    1,
+				ModulePath: "./ci",
+				Paths:      []string{"**/**.go"},
+				Secrets:    []SecretSpec{{Name: "ghUsername", FromEnv: "GITHUB_USERNAME"}},
+				Checkout:   SpecCheckout{Submodules: github.Bool(true)},
+				file:       SpecFile,
+			},
+		},
+		{
+			name:     "index",
+			contents: "specs: ['apps/*/pocketci.yaml']",
+			expected: &Spec{Version: 1, Specs: []string{"apps/*/pocketci.yaml"}, file: SpecFile},
+		},
+		{
+			name:     "index with module",
+			contents: "specs: ['apps/*/pocketci.yaml']\nmodule-path: ./ci",
+			expected: &Spec{Version: 1, ModulePath: "./ci", Specs: []string{"apps/*/pocketci.yaml"}, file: SpecFile},
+		},
+		{
+			name:     "invalid specs",
+			contents: "specs: ['apps/{a,b/pocketci.yaml']",
+			err:      `invalid pocketci.yaml: invalid specs: unbalanced braces in "apps/{a,b/pocketci.yaml"`,
+		},
+		{
+			name:     "unknown field",
+			contents: "module: ./ci",
+			err:      "invalid pocketci.yaml: yaml: unmarshal errors:\n  line 1: field module not found in type pocketci.Spec",
+		},
+		{
+			name:     "wrong type",
+			contents: "module-path: [ci]",
+			err:      "line 1: cannot unmarshal !!seq into string",
+		},
+		{
+			name:     "unsupported version",
+			contents: "version: 2",
+			err:      "invalid pocketci.yaml: unsupported version 2, the latest version is 1",
+		},
+		{
+			name:     "invalid path",
+			contents: "paths: ['src/[a-']",
+			err:      `invalid pocketci.yaml: invalid paths: invalid pattern "src/[a-": syntax error in pattern`,
+		},
+		{
+			name:     "secret without source",
+			contents: "secrets: [{name: ghUsername}]",
+			err:      "invalid pocketci.yaml: secret ghUsername must set exactly one of from-env, from-file, from-store or from-sops",
+		},
+		{
+			name:     "secret with many sources",
+			contents: "secrets: [{name: ghUsername, from-env: A, from-file: a}]",
+			err:      "invalid pocketci.yaml: secret ghUsername must set exactly one of from-env, from-file, from-store or from-sops",
+		},
+		{
+			name:     "sops secret without key",
+			contents: "secrets: [{name: dbPassword, from-sops: secrets.enc.yaml}]",
+			err:      "invalid pocketci.yaml: secret dbPassword must set key along from-sops",
+		},
+		{
+			name:     "secret with unsupported event",
+			contents: "secrets: [{name: token, from-env: A, events: [release]}]",
+			err:      "invalid pocketci.yaml: secret token: unsupported event release",
+		},
+		{
+			name:     "duplicated secret",
+			contents: "secrets: [{name: token, from-env: A}, {name: token, from-env: B}]",
+			err:      "invalid pocketci.yaml: secret token is defined more than once",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, err := parseSpec(SpecFile, []byte(tc.contents))
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, spec, tc.expected, cmpSpec)
+		})
+	}
+}
+
+func TestCollectSpecs(t *testing.T) {
+	root := &Spec{Specs: []string{"apps/*/pocketci.yaml"}, file: SpecFile}
+	files := []string{SpecFile, "apps/web/pocketci.yaml", "tools/lint/pocketci.yaml"}
+
+	cases := []struct {
+		name     string
+		contents string
+		expected *Spec
+		err      string
+	}{
+		{
+			name:     "empty",
+			contents: "",
+			expected: &Spec{Version: 1, ModulePath: "apps/web", Paths: []string{"apps/web/**"}, file: "apps/web/pocketci.yaml"},
+		},
+		{
+			name:     "relative",
+			contents: "module-path: ./ci\npaths: ['**/*.go', '../../go.mod']",
+			expected: &Spec{
+				Version:    1,
+				ModulePath: "apps/web/ci",
+				Paths:      []string{"apps/web/**/*.go", "go.mod"},
+				file:       "apps/web/pocketci.yaml",
+			},
+		},
+		{
+			name:     "specs",
+			contents: "specs: ['*/pocketci.yaml']",
+			err:      "invalid apps/web/pocketci.yaml: only pocketci.yaml can list other specs",
+		},
+		{
+			name:     "checkout",
+			contents: "checkout: {sparse: true}",
+			err:      "invalid apps/web/pocketci.yaml: checkout options can only be set in pocketci.yaml",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			specs, err := collectSpecs(root, files, func(file string) (*Spec, error) {
+				return parseSpec(file, []byte(tc.contents))
+			})
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, specs, []*Spec{tc.expected}, cmpSpec)
+		})
+	}
+}
+
+func TestReadSpecs(t *testing.T) {
+	ctx := context.Background()
+	repo := newTestRepo(t)
+	sha := repo.commit(map[string]string{
+		SpecFile:                   "specs: ['apps/*/pocketci.yaml']",
+		"apps/api/pocketci.yaml":   "module-path: ci",
+		"apps/web/pocketci.yaml":   "paths: ['src/**']",
+		"apps/web/ci/dagger.json":  "{}",
+		"tools/lint/pocketci.yaml": "version: 1",
+	})
+
+	mirrors, err := NewMirrors(t.TempDir(), nil)
+	assert.NilError(t, err)
+	mirror, err := mirrors.Fetch(ctx, repo.url(), sha, "refs/heads/main")
+	assert.NilError(t, err)
+
+	root, err := readSpec(ctx, mirror, sha, SpecFile, nil)
+	assert.NilError(t, err)
+
+	specs, err := readSpecs(ctx, mirror, sha, root, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(specs), 2)
+	assert.Equal(t, specs[0].ModulePath, "apps/api/ci")
+	assert.DeepEqual(t, specs[1].Paths, []string{"apps/web/src/**"})
+
+	assert.DeepEqual(t, discoveryPaths(CheckoutOptions{Sparse: true}, specs),
+		[]string{SpecFile, "apps/api/pocketci.yaml", "apps/api/ci", "apps/web/pocketci.yaml", "apps/web"})
+	assert.Assert(t, discoveryPaths(CheckoutOptions{}, specs) == nil)
+
+	// the root spec is discovered too when it has a module
+	root.ModulePath = "."
+	specs, err = readSpecs(ctx, mirror, sha, root, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, len(specs), 3)
+	assert.Assert(t, discoveryPaths(CheckoutOptions{Sparse: true}, specs) == nil)
+}
+
+func TestSpecSecrets(t *testing.T) {
+	spec := &Spec{Secrets: []SecretSpec{
+		{Name: "ghUsername", FromEnv: "POCKETCI_SECRET_TEST_USERNAME"},
+		{Name: "ghPassword", FromEnv: "POCKETCI_SECRET_TEST_PASSWORD"},
+	}}
+
+	ctx := context.Background()
+	t.Setenv("POCKETCI_SECRET_TEST_USERNAME", "pocketci")
+	_, err := spec.resolveSecrets(ctx, nil, &GithubEvent{})
+	assert.Error(t, err, "secret ghPassword: environment variable POCKETCI_SECRET_TEST_PASSWORD is not set")
+
+	t.Setenv("POCKETCI_SECRET_TEST_PASSWORD", "secret")
+	secrets, err := spec.resolveSecrets(ctx, nil, &GithubEvent{})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, secrets, map[string]string{"ghUsername": "pocketci", "ghPassword": "secret"})
+
+	assert.DeepEqual(t, spec.secretArgs([]string{"src", "ghPassword"}, secrets), []string{"--gh-password", "env:GH_PASSWORD"})
+	assert.DeepEqual(t, spec.secretArgs([]string{"src", "ghPassword"}, map[string]string{}), []string{})
+}
+
+func TestSpecAllowedSecrets(t *testing.T) {
+	spec := &Spec{Secrets: []SecretSpec{
+		{Name: "cacheToken", FromEnv: "CACHE_TOKEN"},
+		{Name: "deployKey", FromEnv: "DEPLOY_KEY", Branches: []string{"main"}},
+	}}
+	secrets := map[string]string{"cacheToken": "cache", "deployKey": "deploy"}
+
+	pullRequest := func(head, base string) *github.PullRequestEvent {
+		return &github.PullRequestEvent{PullRequest: &github.PullRequest{
+			Head: &github.PullRequestBranch{Repo: &github.Repository{FullName: github.String(head)}},
+			Base: &github.PullRequestBranch{Repo: &github.Repository{FullName: github.String(base)}},
+		}}
+	}
+
+	cases := []struct {
+		name     string
+		event    *GithubEvent
+		expected map[string]string
+	}{
+		{
+			name:     "push",
+			event:    &GithubEvent{EventType: GithubPush, Branch: "main", PushEvent: &github.PushEvent{}},
+			expected: secrets,
+		},
+		{
+			name: "pull request matched by its base branch",
+			event: &GithubEvent{EventType: GithubPullRequest, Branch: "feature", BaseBranch: "main",
+				PullRequestEvent: pullRequest("franela/pocketci", "franela/pocketci")},
+			expected: secrets,
+		},
+		{
+			name: "pull request from a head branch named like a protected one",
+			event: &GithubEvent{EventType: GithubPullRequest, Branch: "main", BaseBranch: "develop",
+				PullRequestEvent: pullRequest("franela/pocketci", "franela/pocketci")},
+			expected: map[string]string{"cacheToken": "cache"},
+		},
+		{
+			name: "pull request from a fork",
+			event: &GithubEvent{EventType: GithubPullRequest, Branch: "feature", BaseBranch: "main",
+				PullRequestEvent: pullRequest("someone/pocketci", "franela/pocketci")},
+			expected: map[string]string{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, spec.allowedSecrets(tc.event, secrets), tc.expected)
+		})
+	}
+}
+
+func TestSpecScopeSecrets(t *testing.T) {
+	spec := &Spec{file: SpecFile, Secrets: []SecretSpec{
+		{Name: "ghUsername", FromEnv: "GITHUB_USERNAME"},
+		{Name: "deployKey", FromEnv: "DEPLOY_KEY"},
+	}}
+	secrets := map[string]string{"ghUsername": "pocketci", "deployKey": "secret"}
+
+	cases := []struct {
+		name     string
+		pipeline *Pipeline
+		expected map[string]string
+		err      string
+	}{
+		{
+			name:     "no secrets",
+			pipeline: &Pipeline{Name: "test", Exec: []string{"test"}},
+			expected: map[string]string{},
+		},
+		{
+			name:     "declared secrets",
+			pipeline: &Pipeline{Name: "deploy", Secrets: []string{"deployKey"}, Exec: []string{"deploy --key env:DEPLOY_KEY"}},
+			expected: map[string]string{"deployKey": "secret"},
+		},
+		{
+			name:     "undefined secret",
+			pipeline: &Pipeline{Name: "deploy", Secrets: []string{"awsKey"}},
+			err:      "pipeline deploy declares secret awsKey which is not defined in pocketci.yaml",
+		},
+		{
+			name:     "undeclared secret",
+			pipeline: &Pipeline{Name: "test", Secrets: []string{"ghUsername"}, Exec: []string{"deploy --key env:DEPLOY_KEY"}},
+			err:      "pipeline test references secret deployKey (env:DEPLOY_KEY) without declaring it",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			scoped, err := spec.scopeSecrets(tc.pipeline, secrets)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, scoped, tc.expected)
+		})
+	}
+}
+
+func TestSpecMatchPaths(t *testing.T) {
+	spec := &Spec{Paths: []string{"**/*.go"}}
+	assert.Assert(t, spec.matchPaths([]Change{{Path: "cmd/main.go", Status: ChangeModified}}))
+	assert.Assert(t, !spec.matchPaths([]Change{{Path: "README.md", Status: ChangeModified}}))
+	assert.Assert(t, (&Spec{}).matchPaths(nil))
+}
@@ -2,6 +2,7 @@ package pocketci
 
 import (
 	"encoding/json"
+	"time"
 
 	"dagger.io/dagger"
 	"github.com/google/go-github/v61/github"
@@ -16,6 +17,44 @@ type Webhook struct {
 // CreatePipelineRequest is the payload received on pipeline creation.
 type PipelineDoneRequest struct {
 	ID int `json:"id"`
+	// Attempt is the attempt of the pipeline the agent ran.
+	Attempt int            `json:"attempt"`
+	Status  PipelineStatus `json:"status"`
+	// Logs are the output of the call.
+	Logs string `json:"logs"`
+}
+
+// PipelineStatus is how the call of a pipeline ended.
+type PipelineStatus string
+
+const (
+	PipelineSucceeded PipelineStatus = "succeeded"
+	PipelineFailed    PipelineStatus = "failed"
+	// PipelineTimedOut is set when the call ran past the timeout of the
+	// pipeline, or when its agent didn't report it in time.
+	PipelineTimedOut PipelineStatus = "timed_out"
+	// PipelineInfraError is set when the pipeline failed for reasons other
+	// than its call, e.g. the repository couldn't be checked out or the
+	// agent lost the dagger engine.
+	PipelineInfraError PipelineStatus = "infra_error"
+	// PipelineSkipped is set on the pipelines that didn't run because a
+	// pipeline they run after didn't succeed.
+	PipelineSkipped PipelineStatus = "skipped"
+	// PipelineCancelled is set on the pipelines cancelled by a newer run of
+	// their concurrency group.
+	PipelineCancelled PipelineStatus = "cancelled"
+)
+
+// PipelineStartedRequest is sent by agents when the call of a pipeline starts,
+// once the repository is checked out.
+type PipelineStartedRequest struct {
+	Attempt int `json:"attempt"`
+}
+
+// PipelineCancelledResponse tells the agent running a pipeline whether it has
+// to stop it.
+type PipelineCancelledResponse struct {
+	Cancelled bool `json:"cancelled"`
 }
 
 // PipelineClaimRequest is the payload received when a runner wants to claim
@@ -28,49 +67,186 @@ const (
 	GithubPullRequest = "pull_request"
 	GithubPush        = "push"
 	GithubRelease     = "release"
+
+	// GithubReadyForReview is the pull request action sent when a draft is
+	// marked as ready for review.
+	GithubReadyForReview = "ready_for_review"
 )
 
+// EventTriggerPath is where the event trigger file is made available to the
+// dagger calls.
+const EventTriggerPath = "/event-trigger.json"
+
+// EventTrigger is the file handed to modules describing the event that
+// triggered the call. It is parsed by the `pocketci` module.
+type EventTrigger struct {
+	EventType string `json:"event_type"`
+	// Changes are the paths of the files that changed, FileChanges has the
+	// details of each change.
+	Changes     []string        `json:"changes"`
+	FileChanges []Change        `json:"file_changes"`
+	RepoName    string          `json:"repo_name"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
 // GithubEvent is a wrapper of a github webhook. It centralizes all information
 // used to handle a github event.
 type GithubEvent struct {
 	RawPayload []byte
 
 	EventType string   `json:"event_type"`
-	Changes   []string `json:"changes"`
+	Changes   []Change `json:"changes"`
 
 	Repository     *dagger.Directory `json:"-"`
 	RepositoryName string            `json:"repository_name"`
+	Spec           *Spec             `json:"-"`
 
 	PullRequestEvent *github.PullRequestEvent
 	PushEvent        *github.PushEvent
 
 	Variables map[string]string
 
-	Branch string
-	SHA    string
+	// Ref is the full git reference fetched to check out SHA.
+	Ref        string
+	Branch     string
+	SHA        string
+	BaseBranch string
+	BaseSHA    string
+	MergeRef   string
+	MergeSHA   string
+
+	mirror *Mirror
+}
+
+// MaxRetries is the most times a failed pipeline can be run again.
+const MaxRetries = 10
+
+// MaxRetryBackoff is the longest a retry waits for.
+const MaxRetryBackoff = time.Hour
+
+// RetryPolicy is how many times, and when, a failed pipeline is run again.
+type RetryPolicy struct {
+	Retries int `json:"retries"`
+	// Backoff is the delay before the first retry, as a duration such as
+	// `30s`. It doubles on every retry up to `MaxRetryBackoff`. Retries run
+	// right away when empty.
+	Backoff string `json:"backoff,omitempty"`
+	// InfraOnly only retries pipelines that failed because of an
+	// infrastructure error, not the ones whose call failed or timed out.
+	InfraOnly bool `json:"infra_only,omitempty"`
+}
+
+// retryable returns whether a pipeline that ended with `status` is retried.
+// Cancelled pipelines are never retried.
+func (r *RetryPolicy) retryable(status PipelineStatus) bool {
+	if r.InfraOnly {
+		return status == PipelineInfraError
+	}
+	return status != PipelineSucceeded && status != PipelineCancelled
+}
+
+// retryBackoff returns how long the retry after `attempts` attempts waits
+// when the first one waits for `backoff`.
+func retryBackoff(backoff time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && backoff < MaxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, MaxRetryBackoff)
+}
+
+// ConcurrencyPolicy makes the pipelines of the same group run one at a time,
+// e.g. the deploys to an environment.
+type ConcurrencyPolicy struct {
+	// Group is rendered with the event like calls, e.g. `preview-{{.PR.Number}}`.
+	Group string `json:"group"`
+	// CancelInProgress cancels the pipelines of the group that older runs
+	// queued or are running when a new run enters the group.
+	CancelInProgress bool `json:"cancel_in_progress,omitempty"`
 }
 
 // Pipeline is a user-defined pipeline generated by pocketci's vendor modules.
 type Pipeline struct {
-	Repository   string   `json:"repository"`
-	Runner       string   `json:"runner"`
-	Changes      []string `json:"changes"`
-	Module       string   `json:"module"`
-	Name         string   `json:"name"`
-	Actions      []string `json:"pr_actions"`
-	OnPR         bool     `json:"on_pr"`
-	BaseBranches []string `json:"on_pr_against"`
-	OnPush       bool     `json:"on_push"`
-	Branches     []string `json:"branches"`
-	Exec         []string `json:"exec"`
-	PipelineDeps []string `json:"after"`
+	Repository string   `json:"repository"`
+	Runner     string   `json:"runner"`
+	Changes    []string `json:"changes"`
+	// ChangeStatuses restricts Changes to the files that changed with one of
+	// the statuses, e.g. only added files.
+	ChangeStatuses []ChangeStatus `json:"change_statuses"`
+	Module         string         `json:"module"`
+	Name           string         `json:"name"`
+	Actions        []string       `json:"pr_actions"`
+	OnPR           bool           `json:"on_pr"`
+	MergeRef       bool           `json:"merge_ref"`
+	SkipDrafts     bool           `json:"skip_drafts"`
+	BaseBranches   []string       `json:"on_pr_against"`
+	OnPush         bool           `json:"on_push"`
+	Branches       []string       `json:"branches"`
+	Exec           []string       `json:"exec"`
+	PipelineDeps   []string       `json:"after"`
+	// Paths are the only paths of the repository checked out for the
+	// pipeline. The whole repository is checked out when empty.
+	Paths []string `json:"paths"`
+
+	// Snapshot is set by pocketci to the digest of the snapshot with the
+	// tree the pipeline checks out.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// Secrets are the names of the secrets of the spec the pipeline uses.
+	Secrets []string `json:"secrets"`
+	// Matrix fans the pipeline out into a job for each of its combinations.
+	Matrix *Matrix `json:"matrix,omitempty"`
+	// Timeout is the longest the call of the pipeline can run, as a duration
+	// such as `30m`. There is no limit when empty.
+	Timeout string `json:"timeout,omitempty"`
+	// Retry re-runs the pipeline when it fails.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Concurrency limits the pipelines of a group to one at a time.
+	Concurrency *ConcurrencyPolicy `json:"concurrency,omitempty"`
+	// Env are environment variables of the call. They take precedence over
+	// the configured variables.
+	Env map[string]string `json:"env,omitempty"`
+	// If is a condition, see `Condition`, that has to hold for the event to
+	// trigger the pipeline. Pipelines without triggers run on every event
+	// the condition holds for.
+	If string `json:"if,omitempty"`
+
+	// MatrixValues is set by pocketci to the combination of the matrix the
+	// job runs with.
+	MatrixValues map[string]string `json:"matrix_values,omitempty"`
+
+	// secrets are the values of the secrets the pipeline declares by name.
+	secrets map[string]string
+	// spec is the spec the pipeline was discovered from.
+	spec *Spec
+	// variables are the environment variables of the pipeline.
+	variables map[string]string
+
+	// EventTrigger is set by pocketci to the trigger of the event the
+	// pipeline was discovered for.
+	EventTrigger json.RawMessage `json:"event_trigger,omitempty"`
+}
+
+// staleMerge reports whether the merge ref was computed against a commit of
+// `baseBranch` other than `baseSHA`.
+func (g GitInfo) staleMerge(baseBranch, baseSHA string) bool {
+	return g.MergeSHA != "" && g.BaseBranch == baseBranch && g.BaseSHA != baseSHA
 }
 
 // GitInfo collects all relevant git information that is sent attached to a given
 // set of pipelines.
 type GitInfo struct {
+	// Ref is the full git reference that has to be fetched to get SHA. For
+	// pull requests this is `refs/pull/<number>/head`.
+	Ref        string `json:"ref"`
 	Branch     string `json:"branch"`
 	SHA        string `json:"sha"`
 	BaseBranch string `json:"base_branch"`
 	BaseSHA    string `json:"base_sha"`
+	// MergeRef and MergeSHA are the `refs/pull/<number>/merge` ref of a pull
+	// request and the commit it resolved to, set when a pipeline tests the
+	// result of merging the pull request instead of its head.
+	MergeRef string `json:"merge_ref,omitempty"`
+	MergeSHA string `json:"merge_sha,omitempty"`
+
+	Checkout CheckoutOptions `json:"checkout"`
 }
@@ -0,0 +1,336 @@
+package pocketci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"dagger.io/dagger"
+	"github.com/google/go-github/v61/github"
+)
+
+// ValidatePipelines reports every problem of the pipelines discovered for a
+// repository: pipelines without a name or a call, duplicated names, unknown or
+// circular dependencies, invalid globs, unknown change statuses, matrices that
+// can't be expanded, calls or variables that can't be rendered, invalid
+// timeouts or retry policies, invalid conditions and empty concurrency groups.
+func ValidatePipelines(pipelines []*Pipeline) error {
+	errs := []error{}
+	for _, problem := range validatePipelines(pipelines) {
+		errs = append(errs, problem.err)
+	}
+	return errors.Join(errs...)
+}
+
+// pipelineProblem is a problem found by `validatePipelines` and the pipelines
+// it makes invalid.
+type pipelineProblem struct {
+	err       error
+	pipelines []*Pipeline
+}
+
+// validatePipelines returns the problems of the pipelines in the order they
+// are found.
+func validatePipelines(pipelines []*Pipeline) []pipelineProblem {
+	problems := []pipelineProblem{}
+	report := func(err error, pipelines ...*Pipeline) {
+		problems = append(problems, pipelineProblem{err: err, pipelines: pipelines})
+	}
+
+	byName := map[string]*Pipeline{}
+	for i, p := range pipelines {
+		if p.Name == "" {
+			report(fmt.Errorf("pipeline %d has no name", i), p)
+			continue
+		}
+		if _, ok := byName[p.Name]; ok {
+			// every pipeline with the name is invalid as dependencies can't
+			// tell them apart
+			report(fmt.Errorf("pipeline %s is defined more than once", p.Name), slices.DeleteFunc(slices.Clone(pipelines), func(other *Pipeline) bool {
+				return other.Name != p.Name
+			})...)
+			continue
+		}
+		byName[p.Name] = p
+	}
+
+	for _, p := range pipelines {
+		if len(p.Exec) == 0 || slices.ContainsFunc(p.Exec, func(exec string) bool { return strings.TrimSpace(exec) == "" }) {
+			report(fmt.Errorf("pipeline %s has an empty call", p.Name), p)
+		}
+
+		for _, pattern := range slices.Concat(p.Changes, p.Paths, p.BaseBranches) {
+			if err := validatePattern(pattern); err != nil {
+				report(fmt.Errorf("pipeline %s: %w", p.Name, err), p)
+			}
+		}
+
+		for _, status := range p.ChangeStatuses {
+			if !slices.Contains([]ChangeStatus{ChangeAdded, ChangeModified, ChangeDeleted, ChangeRenamed}, status) {
+				report(fmt.Errorf("pipeline %s: unknown change status %s", p.Name, status), p)
+			}
+		}
+
+		for name := range p.Env {
+			if !variableName.MatchString(name) {
+				report(fmt.Errorf("pipeline %s: invalid variable name %q", p.Name, name), p)
+			}
+		}
+
+		// calls are rendered with an empty event to report the ones that
+		// reference unknown fields before any event renders them
+		if jobs, err := expandMatrix(p); err != nil {
+			report(fmt.Errorf("pipeline %s: %w", p.Name, err), p)
+		} else if err := renderPipelines(&GithubEvent{}, clonePipelines(jobs)); err != nil {
+			report(err, p)
+		}
+
+		if p.Timeout != "" {
+			if timeout, err := time.ParseDuration(p.Timeout); err != nil || timeout <= 0 {
+				report(fmt.Errorf("pipeline %s: invalid timeout %q", p.Name, p.Timeout), p)
+			}
+		}
+
+		if p.Concurrency != nil && strings.TrimSpace(p.Concurrency.Group) == "" {
+			report(fmt.Errorf("pipeline %s has an empty concurrency group", p.Name), p)
+		}
+
+		if p.If != "" {
+			if _, err := ParseCondition(p.If); err != nil {
+				report(fmt.Errorf("pipeline %s: %w", p.Name, err), p)
+			}
+		}
+
+		if p.Retry != nil {
+			if p.Retry.Retries < 0 || p.Retry.Retries > MaxRetries {
+				report(fmt.Errorf("pipeline %s: invalid number of retries %d, it must be between 0 and %d", p.Name, p.Retry.Retries, MaxRetries), p)
+			}
+			if p.Retry.Backoff != "" {
+				if backoff, err := time.ParseDuration(p.Retry.Backoff); err != nil || backoff < 0 || backoff > MaxRetryBackoff {
+					report(fmt.Errorf("pipeline %s: invalid retry backoff %q", p.Name, p.Retry.Backoff), p)
+				}
+			}
+		}
+
+		for _, dep := range p.PipelineDeps {
+			if _, ok := byName[dep]; !ok {
+				report(fmt.Errorf("pipeline %s runs after unknown pipeline %s", p.Name, dep), p)
+			}
+		}
+	}
+
+	if cycle := findCycle(pipelines, byName); cycle != nil {
+		inCycle := []*Pipeline{}
+		for _, name := range cycle[:len(cycle)-1] {
+			inCycle = append(inCycle, byName[name])
+		}
+		report(fmt.Errorf("pipelines have a circular dependency: %s", strings.Join(cycle, " -> ")), inCycle...)
+	}
+
+	return problems
+}
+
+// skipInvalidPipelines removes the pipelines with problems, and the ones that
+// run after them, so an invalid pipeline doesn't keep the rest of the
+// pipelines of an event from running.
+func skipInvalidPipelines(pipelines []*Pipeline) ([]*Pipeline, []SkippedPipeline) {
+	reasons := map[*Pipeline][]string{}
+	for _, problem := range validatePipelines(pipelines) {
+		for _, p := range problem.pipelines {
+			reasons[p] = append(reasons[p], problem.err.Error())
+		}
+	}
+
+	invalid := map[string]bool{}
+	skipped := []SkippedPipeline{}
+	valid := []*Pipeline{}
+	for _, p := range pipelines {
+		if len(reasons[p]) > 0 {
+			invalid[p.Name] = true
+			skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: "invalid pipeline: " + strings.Join(reasons[p], "; ")})
+			continue
+		}
+		valid = append(valid, p)
+	}
+
+	// pipelines that run after a skipped one are skipped as well, repeating
+	// until no other pipeline runs after them
+	for changed := true; changed; {
+		changed = false
+		valid = slices.DeleteFunc(valid, func(p *Pipeline) bool {
+			i := slices.IndexFunc(p.PipelineDeps, func(dep string) bool { return invalid[dep] })
+			if i < 0 {
+				return false
+			}
+			invalid[p.Name] = true
+			skipped = append(skipped, SkippedPipeline{Name: p.Name, Reason: fmt.Sprintf("runs after invalid pipeline %s", p.PipelineDeps[i])})
+			changed = true
+			return true
+		})
+	}
+	return valid, skipped
+}
+
+// clonePipelines returns shallow copies of the pipelines.
+func clonePipelines(pipelines []*Pipeline) []*Pipeline {
+	clones := []*Pipeline{}
+	for _, p := range pipelines {
+		c := *p
+		clones = append(clones, &c)
+	}
+	return clones
+}
+
+// findCycle returns the names of the pipelines of the first circular
+// dependency, the first one repeated at the end, or nil when there are none.
+func findCycle(pipelines []*Pipeline, byName map[string]*Pipeline) []string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	stack := []string{}
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		switch state[name] {
+		case visiting:
+			start := slices.Index(stack, name)
+			return append(slices.Clone(stack[start:]), name)
+		case visited:
+			return nil
+		}
+
+		p, ok := byName[name]
+		if !ok {
+			return nil
+		}
+
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range p.PipelineDeps {
+			if cycle := visit(dep); cycle != nil {
+				return cycle
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, p := range pipelines {
+		if cycle := visit(p.Name); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
+
+// placeholderSecrets resolves every secret to a placeholder so pipelines can
+// be discovered without access to the secrets.
+type placeholderSecrets struct{}
+
+func (placeholderSecrets) Lookup(ctx context.Context, req SecretRequest) (string, error) {
+	return "pocketci-validate", nil
+}
+
+// Validate discovers the pipelines of the specs of the git working tree at
+// `dir`, as if it was pushed to `branch` of `repository`, and validates them.
+// Secrets are not resolved, discovery gets a placeholder for each of them.
+// Specs can't include others when `includes` is nil.
+func Validate(ctx context.Context, dag *dagger.Client, includes *SpecIncludes, dir, repository, branch string) ([]*Pipeline, error) {
+	load := func(file string) (*Spec, error) {
+		contents, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		spec, err := parseSpec(file, contents)
+		if err != nil {
+			return nil, err
+		}
+		if err := includes.resolve(ctx, spec); err != nil {
+			return nil, err
+		}
+		return spec, nil
+	}
+
+	root, err := load(SpecFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// untracked files are included so they can be validated before being
+	// committed
+	out, err := runGit(ctx, dir, nil, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	specs, err := collectSpecs(root, files, load)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := localEvent(ctx, dir, repository, branch, files)
+	if err != nil {
+		return nil, err
+	}
+	event.Spec = root
+	event.Repository = dag.Host().Directory(dir, dagger.HostDirectoryOpts{Exclude: []string{".git"}})
+
+	o := &Orchestrator{
+		dag:     dag,
+		Secrets: &SecretBackends{Env: placeholderSecrets{}, File: placeholderSecrets{}, Store: placeholderSecrets{}, Sops: placeholderSecrets{}},
+	}
+	pipelines, err := o.discover(ctx, event, specs)
+	if err != nil {
+		return nil, err
+	}
+	return pipelines, ValidatePipelines(pipelines)
+}
+
+// localEvent returns a push of the working tree at `dir` to `branch` where
+// every file changed.
+func localEvent(ctx context.Context, dir, repository, branch string, files []string) (*GithubEvent, error) {
+	sha, _ := runGit(ctx, dir, nil, "rev-parse", "HEAD")
+	sha = strings.TrimSpace(sha)
+
+	push := &github.PushEvent{
+		Ref:        github.String("refs/heads/" + branch),
+		After:      github.String(sha),
+		HeadCommit: &github.HeadCommit{ID: github.String(sha), Message: github.String("")},
+		Repo:       &github.PushEventRepository{FullName: github.String(repository), DefaultBranch: github.String(branch)},
+	}
+	payload, err := json.Marshal(push)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Change{}
+	for _, file := range files {
+		changes = append(changes, Change{Path: file, Status: ChangeAdded})
+	}
+
+	return &GithubEvent{
+		RawPayload:     payload,
+		EventType:      GithubPush,
+		Changes:        changes,
+		RepositoryName: repository,
+		PushEvent:      push,
+		Ref:            "refs/heads/" + branch,
+		Branch:         branch,
+		SHA:            sha,
+	}, nil
+}
@@ -0,0 +1,143 @@
+package pocketci
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestValidatePipelines(t *testing.T) {
+	cases := []struct {
+		name      string
+		pipelines []*Pipeline
+		err       string
+	}{
+		{
+			name: "valid",
+			pipelines: []*Pipeline{
+				{Name: "test", Exec: []string{"test"}, Changes: []string{"**/*.go"}},
+				{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"test"}},
+			},
+		},
+		{
+			name:      "no name",
+			pipelines: []*Pipeline{{Exec: []string{"test"}}},
+			err:       "pipeline 0 has no name",
+		},
+		{
+			name: "duplicated name",
+			pipelines: []*Pipeline{
+				{Name: "test", Exec: []string{"test"}},
+				{Name: "test", Exec: []string{"lint"}},
+			},
+			err: "pipeline test is defined more than once",
+		},
+		{
+			name:      "empty call",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{" "}}},
+			err:       "pipeline test has an empty call",
+		},
+		{
+			name:      "unknown dependency",
+			pipelines: []*Pipeline{{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"tests"}}},
+			err:       "pipeline publish runs after unknown pipeline tests",
+		},
+		{
+			name: "circular dependency",
+			pipelines: []*Pipeline{
+				{Name: "test", Exec: []string{"test"}},
+				{Name: "build", Exec: []string{"build"}, PipelineDeps: []string{"test", "publish"}},
+				{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"build"}},
+			},
+			err: "pipelines have a circular dependency: build -> publish -> build",
+		},
+		{
+			name:      "invalid glob",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{"test"}, Paths: []string{"src/[a-"}}},
+			err:       `pipeline test: invalid pattern "src/[a-": syntax error in pattern`,
+		},
+		{
+			name:      "unknown change status",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{"test"}, ChangeStatuses: []ChangeStatus{"copied"}}},
+			err:       "pipeline test: unknown change status copied",
+		},
+		{
+			name:      "invalid timeout",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{"test"}, Timeout: "30"}},
+			err:       `pipeline test: invalid timeout "30"`,
+		},
+		{
+			name:      "invalid retry policy",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{"test"}, Retry: &RetryPolicy{Retries: -1, Backoff: "soon"}}},
+			err:       "pipeline test: invalid number of retries -1, it must be between 0 and 10\npipeline test: invalid retry backoff \"soon\"",
+		},
+		{
+			name:      "retry policy out of bounds",
+			pipelines: []*Pipeline{{Name: "test", Exec: []string{"test"}, Retry: &RetryPolicy{Retries: 1 << 40, Backoff: "2h"}}},
+			err:       "pipeline test: invalid number of retries 1099511627776, it must be between 0 and 10\npipeline test: invalid retry backoff \"2h\"",
+		},
+		{
+			name:      "invalid condition",
+			pipelines: []*Pipeline{{Name: "deploy", Exec: []string{"deploy"}, If: `labels == "deploy"`}},
+			err:       `pipeline deploy: invalid condition "labels == \"deploy\"": left operand of == must be a string, got a list`,
+		},
+		{
+			name:      "unknown call field",
+			pipelines: []*Pipeline{{Name: "publish", Exec: []string{"publish --tag {{.Tag}}"}}},
+			err:       `pipeline publish: template: call:1:16: executing "call" at <.Tag>: map has no entry for key "Tag"`,
+		},
+		{
+			name:      "invalid env",
+			pipelines: []*Pipeline{{Name: "publish", Exec: []string{"publish"}, Env: map[string]string{"IMAGE-TAG": "latest"}}},
+			err:       `pipeline publish: invalid variable name "IMAGE-TAG"`,
+		},
+		{
+			name:      "empty concurrency group",
+			pipelines: []*Pipeline{{Name: "deploy", Exec: []string{"deploy"}, Concurrency: &ConcurrencyPolicy{Group: " "}}},
+			err:       "pipeline deploy has an empty concurrency group",
+		},
+		{
+			name: "every problem is reported",
+			pipelines: []*Pipeline{
+				{Name: "test"},
+				{Name: "lint", Exec: []string{"lint"}, PipelineDeps: []string{"tests"}},
+			},
+			err: "pipeline test has an empty call\npipeline lint runs after unknown pipeline tests",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidatePipelines(tc.pipelines)
+			if tc.err != "" {
+				assert.Error(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+		})
+	}
+}
+
+func TestSkipInvalidPipelines(t *testing.T) {
+	pipelines := []*Pipeline{
+		{Name: "test", Exec: []string{"test"}},
+		{Name: "build"},
+		{Name: "publish", Exec: []string{"publish"}, PipelineDeps: []string{"build"}},
+		{Name: "release", Exec: []string{"release"}, PipelineDeps: []string{"publish"}},
+		{Name: "lint", Exec: []string{"lint"}, PipelineDeps: []string{"test"}},
+		{Name: "deploy", Exec: []string{"deploy"}, Timeout: "soon"},
+	}
+
+	valid, skipped := skipInvalidPipelines(pipelines)
+	names := []string{}
+	for _, p := range valid {
+		names = append(names, p.Name)
+	}
+	assert.DeepEqual(t, names, []string{"test", "lint"})
+	assert.DeepEqual(t, skipped, []SkippedPipeline{
+		{Name: "build", Reason: "invalid pipeline: pipeline build has an empty call"},
+		{Name: "deploy", Reason: `invalid pipeline: pipeline deploy: invalid timeout "soon"`},
+		{Name: "publish", Reason: "runs after invalid pipeline build"},
+		{Name: "release", Reason: "runs after invalid pipeline publish"},
+	})
+}
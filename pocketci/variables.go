@@ -0,0 +1,98 @@
+package pocketci
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"dagger.io/dagger"
+)
+
+// Variables are non-secret environment variables injected into the pipelines,
+// e.g. registry hostnames or environment names. They are merged from the
+// least to the most specific level: global, organization, repository and
+// branch. The variables pocketci sets for every event take precedence.
+type Variables struct {
+	Global map[string]string `yaml:"global"`
+	// Organizations are keyed by the name of the organization, e.g. `franela`.
+	Organizations map[string]map[string]string `yaml:"organizations"`
+	// Repositories are keyed by their full name, e.g. `franela/pocketci`.
+	Repositories map[string]map[string]string `yaml:"repositories"`
+	// Branches are applied in order, so later rules take precedence over
+	// earlier ones when more than one matches.
+	Branches []BranchVariables `yaml:"branches"`
+}
+
+// BranchVariables are the variables of the branches matching `Branch` of the
+// repositories matching `Repository`.
+type BranchVariables struct {
+	// Repository is a glob matched against the full name of repositories.
+	// Any repository when empty.
+	Repository string            `yaml:"repository"`
+	Branch     string            `yaml:"branch"`
+	Variables  map[string]string `yaml:"variables"`
+}
+
+var variableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (v *Variables) validate() error {
+	levels := []map[string]string{v.Global}
+	levels = slices.AppendSeq(levels, maps.Values(v.Organizations))
+	levels = slices.AppendSeq(levels, maps.Values(v.Repositories))
+
+	for i, rule := range v.Branches {
+		if rule.Branch == "" {
+			return fmt.Errorf("branch variables %d: branch is required", i)
+		}
+		for _, pattern := range []string{rule.Repository, rule.Branch} {
+			if err := validatePattern(pattern); err != nil {
+				return fmt.Errorf("branch variables %d: %w", i, err)
+			}
+		}
+		levels = append(levels, rule.Variables)
+	}
+
+	for _, vars := range levels {
+		for name := range vars {
+			if !variableName.MatchString(name) {
+				return fmt.Errorf("invalid variable name %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve returns the variables of `branch` of `repository`.
+func (v *Variables) Resolve(repository, branch string) map[string]string {
+	vars := map[string]string{}
+	if v == nil {
+		return vars
+	}
+
+	org, _, _ := strings.Cut(repository, "/")
+	maps.Copy(vars, v.Global)
+	maps.Copy(vars, v.Organizations[org])
+	maps.Copy(vars, v.Repositories[repository])
+	for _, rule := range v.Branches {
+		if rule.Repository != "" && !Match([]string{repository}, rule.Repository) {
+			continue
+		}
+		if Match([]string{branch}, rule.Branch) {
+			maps.Copy(vars, rule.Variables)
+		}
+	}
+	return vars
+}
+
+// WithVariables sets `vars` as environment variables of the container, so
+// they are available to the calls made in it.
+func WithVariables(vars map[string]string) dagger.WithContainerFunc {
+	return func(c *dagger.Container) *dagger.Container {
+		for _, name := range slices.Sorted(maps.Keys(vars)) {
+			c = c.WithEnvVariable(name, vars[name])
+		}
+		return c
+	}
+}
@@ -0,0 +1,109 @@
+package pocketci
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestVariablesResolve(t *testing.T) {
+	vars := &Variables{
+		Global:        map[string]string{"REGISTRY": "ghcr.io", "ENVIRONMENT": "dev"},
+		Organizations: map[string]map[string]string{"franela": {"ENVIRONMENT": "staging"}},
+		Repositories:  map[string]map[string]string{"franela/pocketci": {"REGISTRY": "registry.example.com"}},
+		Branches: []BranchVariables{
+			{Branch: "release/*", Variables: map[string]string{"ENVIRONMENT": "production"}},
+			{Repository: "franela/*", Branch: "release/1.*", Variables: map[string]string{"ENVIRONMENT": "legacy"}},
+		},
+	}
+
+	cases := []struct {
+		name       string
+		repository string
+		branch     string
+		expected   map[string]string
+	}{
+		{
+			name:       "global",
+			repository: "other/repo",
+			branch:     "main",
+			expected:   map[string]string{"REGISTRY": "ghcr.io", "ENVIRONMENT": "dev"},
+		},
+		{
+			name:       "organization and repository",
+			repository: "franela/pocketci",
+			branch:     "main",
+			expected:   map[string]string{"REGISTRY": "registry.example.com", "ENVIRONMENT": "staging"},
+		},
+		{
+			name:       "branch",
+			repository: "other/repo",
+			branch:     "release/2.0",
+			expected:   map[string]string{"REGISTRY": "ghcr.io", "ENVIRONMENT": "production"},
+		},
+		{
+			name:       "later branch rules take precedence",
+			repository: "franela/pocketci",
+			branch:     "release/1.2",
+			expected:   map[string]string{"REGISTRY": "registry.example.com", "ENVIRONMENT": "legacy"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.DeepEqual(t, vars.Resolve(tc.repository, tc.branch), tc.expected)
+		})
+	}
+
+	assert.DeepEqual(t, (*Variables)(nil).Resolve("franela/pocketci", "main"), map[string]string{})
+}
+
+func TestConfigVariables(t *testing.T) {
+	cases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "valid",
+			config: `
+variables:
+  global:
+    REGISTRY: ghcr.io
+  organizations:
+    franela:
+      ENVIRONMENT: staging
+  branches:
+    - branch: release/*
+      variables:
+        ENVIRONMENT: production
+`,
+		},
+		{
+			name:   "invalid name",
+			config: "variables: {global: {REGISTRY-HOST: ghcr.io}}",
+			err:    `invalid variable name "REGISTRY-HOST"`,
+		},
+		{
+			name:   "branch rule without branch",
+			config: "variables: {branches: [{variables: {A: b}}]}",
+			err:    "branch variables 0: branch is required",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			assert.NilError(t, os.WriteFile(path, []byte(tc.config), 0o644))
+
+			_, err := LoadConfig(path)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NilError(t, err)
+		})
+	}
+}